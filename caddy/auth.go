@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// BasicAuthUser is a user allowed to access a route protected by basic auth.
+type BasicAuthUser struct {
+	Username string
+	// PasswordHash is the bcrypt hash of the user's password.
+	PasswordHash string
+}
+
+// ForwardAuth delegates authentication of a route's requests to another service.
+type ForwardAuth struct {
+	UpstreamName string
+	UpstreamPort int32
+	UpstreamSvc  *dagger.Service
+	// URI is the path requested from the auth service.
+	URI string
+	// CopyHeaders are headers copied from the auth service's response to
+	// the proxied request, e.g. Remote-User
+	CopyHeaders []string
+}
+
+// WithBasicAuth protects the routes to the named upstream with HTTP basic auth.
+// The password is hashed with bcrypt when this function is called, only the
+// hash ends up in the Caddyfile.
+func (c *Caddy) WithBasicAuth(
+	ctx context.Context,
+	// The upstream name of the routes to protect.
+	upstreamName string,
+	username string,
+	password *dagger.Secret,
+) (*Caddy, error) {
+	// fail before hashing the password if there is nothing to protect
+	routes, err := c.routesTo(upstreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := dag.Container().
+		From(c.imageRef()).
+		WithSecretVariable("CADDY_PASSWORD", password).
+		WithExec([]string{"sh", "-c", `caddy hash-password --plaintext "$CADDY_PASSWORD"`}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password of basic auth user %q: %w", username, err)
+	}
+
+	for _, svc := range routes {
+		svc.BasicAuth = append(svc.BasicAuth, &BasicAuthUser{
+			Username:     username,
+			PasswordHash: strings.TrimSpace(hash),
+		})
+	}
+
+	return c, nil
+}
+
+// WithForwardAuth protects the routes to the named upstream by asking the auth
+// service first: requests are proxied if it responds with a 2xx status, and get
+// its response otherwise.
+func (c *Caddy) WithForwardAuth(
+	ctx context.Context,
+	// The upstream name of the routes to protect.
+	upstreamName string,
+	authService *dagger.Service,
+	// The name used to bind the auth service in the caddy container.
+	authName string,
+	authPort int32,
+	// The path requested from the auth service.
+	//
+	// +default="/"
+	uri string,
+	// Headers copied from the auth service's response to the proxied request,
+	// e.g. Remote-User
+	//
+	// +optional
+	copyHeaders []string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.ForwardAuth = &ForwardAuth{
+			UpstreamName: authName,
+			UpstreamPort: authPort,
+			UpstreamSvc:  authService,
+			URI:          uri,
+			CopyHeaders:  copyHeaders,
+		}
+	})
+}
+
+// authDirectives returns the directives protecting the route, if any.
+func (svc *ServiceConfig) authDirectives() []*directive {
+	var directives []*directive
+	if len(svc.BasicAuth) > 0 {
+		basicAuth := newDirective("basic_auth")
+		for _, user := range svc.BasicAuth {
+			basicAuth.withBlock(newDirective(user.Username, user.PasswordHash))
+		}
+
+		directives = append(directives, basicAuth)
+	}
+
+	if auth := svc.ForwardAuth; auth != nil {
+		forwardAuth := newDirective("forward_auth", net.JoinHostPort(auth.UpstreamName, strconv.Itoa(int(auth.UpstreamPort)))).
+			withBlock(newDirective("uri", auth.URI))
+		if len(auth.CopyHeaders) > 0 {
+			forwardAuth.withBlock(newDirective("copy_headers", auth.CopyHeaders...))
+		}
+
+		directives = append(directives, forwardAuth)
+	}
+
+	return directives
+}
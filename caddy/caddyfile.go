@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// caddyfile is a typed model of the generated Caddyfile.
+type caddyfile struct {
+	// Global holds the directives of the global options block.
+	Global []*directive
+	Sites  []*site
+}
+
+// site is a site block, served on one or more addresses.
+type site struct {
+	Addresses  []string
+	Directives []*directive
+}
+
+// directive is a single Caddyfile directive (or subdirective) with its
+// arguments and an optional block of nested directives.
+type directive struct {
+	Name  string
+	Args  []string
+	Block []*directive
+
+	// Raw, when set, is written verbatim instead of Name, Args and Block.
+	Raw string
+}
+
+func newDirective(name string, args ...string) *directive {
+	return &directive{Name: name, Args: args}
+}
+
+// withBlock appends nested directives and returns the directive, so that
+// blocks can be built inline.
+func (d *directive) withBlock(block ...*directive) *directive {
+	d.Block = append(d.Block, block...)
+	return d
+}
+
+// String renders the model in Caddyfile syntax.
+func (cf *caddyfile) String() string {
+	var b strings.Builder
+	if len(cf.Global) > 0 {
+		b.WriteString("{\n")
+		writeDirectives(&b, cf.Global, 1)
+		b.WriteString("}\n")
+	}
+
+	for _, s := range cf.Sites {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+
+		addresses := make([]string, 0, len(s.Addresses))
+		for _, address := range s.Addresses {
+			addresses = append(addresses, quoteToken(address))
+		}
+
+		fmt.Fprintf(&b, "%s {\n", strings.Join(addresses, ", "))
+		writeDirectives(&b, s.Directives, 1)
+		b.WriteString("}\n")
+	}
+
+	return b.String()
+}
+
+func writeDirectives(b *strings.Builder, directives []*directive, depth int) {
+	indent := strings.Repeat("\t", depth)
+	for _, d := range directives {
+		if d.Raw != "" {
+			for _, line := range strings.Split(strings.TrimRight(d.Raw, "\n"), "\n") {
+				if strings.TrimSpace(line) != "" {
+					b.WriteString(indent)
+				}
+				b.WriteString(line)
+				b.WriteString("\n")
+			}
+			continue
+		}
+
+		b.WriteString(indent)
+		b.WriteString(d.Name)
+		for _, arg := range d.Args {
+			b.WriteString(" ")
+			b.WriteString(quoteToken(arg))
+		}
+
+		if len(d.Block) == 0 {
+			b.WriteString("\n")
+			continue
+		}
+
+		b.WriteString(" {\n")
+		writeDirectives(b, d.Block, depth+1)
+		b.WriteString(indent)
+		b.WriteString("}\n")
+	}
+}
+
+// quoteToken quotes a token if the Caddyfile lexer would otherwise split it,
+// treat it as a comment or as the start or end of a block.
+//
+// The lexer only unescapes \" in quoted tokens, so a backslash before a quote
+// can't be written in one. Such tokens are written as backtick quoted raw
+// tokens instead, or as a heredoc if they contain backticks as well.
+func quoteToken(token string) string {
+	if token != "" && token != "{" && token != "}" &&
+		!strings.HasPrefix(token, "#") &&
+		!strings.HasPrefix(token, "<<") &&
+		!strings.ContainsAny(token, " \t\r\n\"`\\") {
+		return token
+	}
+
+	switch {
+	case !strings.ContainsAny(token, `"\`):
+		return `"` + token + `"`
+	case !strings.Contains(token, "`"):
+		return "`" + token + "`"
+	case !strings.Contains(token, `\`):
+		return `"` + strings.ReplaceAll(token, `"`, `\"`) + `"`
+	}
+
+	return heredoc(token)
+}
+
+// heredoc returns the token as a heredoc, with a marker that is not a line
+// of the token.
+func heredoc(token string) string {
+	lines := strings.Split(token, "\n")
+	marker := "EOF"
+	for i := 1; slices.ContainsFunc(lines, func(line string) bool {
+		return strings.TrimSpace(line) == marker
+	}); i++ {
+		marker = "EOF" + strconv.Itoa(i)
+	}
+
+	return "<<" + marker + "\n" + token + "\n" + marker
+}
+
+// caddyfile builds the typed model from the configured services.
+func (c *Caddy) caddyfile() *caddyfile {
+	cf := &caddyfile{}
+	if c.InternalTLS {
+		cf.Global = append(cf.Global, internalTLSOptions()...)
+	}
+
+	if servers := c.serverOptions(); servers != nil {
+		cf.Global = append(cf.Global, servers)
+	}
+
+	if c.usesRateLimits() {
+		// rate_limit is a plugin directive, so caddy needs to be told where
+		// it goes; limit requests before spending time authenticating them.
+		cf.Global = append(cf.Global, newDirective("order", "rate_limit", "before", "basic_auth"))
+	}
+
+	if c.usesL4() {
+		cf.Global = append(cf.Global, c.layer4())
+	}
+
+	for _, snippet := range c.GlobalSnippets {
+		cf.Global = append(cf.Global, &directive{Raw: snippet})
+	}
+
+	var keys []string
+	sites := map[string]*site{}
+	routes := map[string][]*ServiceConfig{}
+	for _, svc := range c.Services {
+		addresses := c.siteAddresses(svc)
+		key := strings.Join(addresses, ", ")
+		if _, ok := sites[key]; !ok {
+			keys = append(keys, key)
+			sites[key] = &site{Addresses: addresses}
+			cf.Sites = append(cf.Sites, sites[key])
+		}
+
+		routes[key] = append(routes[key], svc)
+	}
+
+	if c.Metrics {
+		cf.Sites = append(cf.Sites, metricsSite(c.MetricsPort))
+	}
+
+	cf.Sites = append(cf.Sites, c.redirectSites()...)
+	cf.Sites = append(cf.Sites, c.mirrorSites()...)
+
+	for _, key := range keys {
+		if tls := c.siteTLS(routes[key][0]); tls != nil {
+			sites[key].Directives = append(sites[key].Directives, tls)
+		}
+
+		if c.AccessLog {
+			sites[key].Directives = append(sites[key].Directives, accessLog())
+		}
+
+		sites[key].Directives = append(sites[key].Directives, c.siteRoutes(routes[key])...)
+
+		// routes of the same upstream may share a site, so add their snippets once.
+		snippets := map[string]bool{}
+		for _, svc := range routes[key] {
+			for _, snippet := range svc.SiteSnippets {
+				if !snippets[snippet] {
+					sites[key].Directives = append(sites[key].Directives, &directive{Raw: snippet})
+					snippets[snippet] = true
+				}
+			}
+		}
+	}
+
+	return cf
+}
+
+// serverOptions returns the global options of caddy's http servers, or nil
+// if the defaults are fine.
+func (c *Caddy) serverOptions() *directive {
+	servers := newDirective("servers")
+	if c.usesH2C() {
+		// let clients like gRPC speak cleartext HTTP/2 to caddy as well
+		servers.withBlock(newDirective("protocols", "h1", "h2", "h2c", "h3"))
+	}
+
+	if c.Metrics {
+		servers.withBlock(newDirective("metrics"))
+	}
+
+	if len(servers.Block) == 0 {
+		return nil
+	}
+
+	return servers
+}
+
+// siteRoutes returns the directives routing a site's requests to its services.
+func (c *Caddy) siteRoutes(routes []*ServiceConfig) []*directive {
+	if len(routes) == 1 && routes[0].Path == "" {
+		return c.routeDirectives(routes[0])
+	}
+
+	// caddy sorts handle blocks by specificity on its own as well, but
+	// keeping the same order here makes the generated file easier to read.
+	routes = append([]*ServiceConfig(nil), routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return pathSpecificity(routes[i].Path) > pathSpecificity(routes[j].Path)
+	})
+
+	directives := make([]*directive, 0, len(routes))
+	for _, svc := range routes {
+		// handle_path requires a path matcher, and there is no prefix
+		// to strip for the catch-all route anyway.
+		handle := newDirective("handle")
+		if !isCatchAllPath(svc.Path) {
+			handle.Args = []string{svc.Path}
+			if svc.StripPrefix {
+				handle.Name = "handle_path"
+			}
+		}
+
+		directives = append(directives, handle.withBlock(c.routeDirectives(svc)...))
+	}
+
+	return directives
+}
+
+// routeDirectives returns the directives handling the requests of a route.
+func (c *Caddy) routeDirectives(svc *ServiceConfig) []*directive {
+	var directives []*directive
+	if headers := svc.responseHeaders(); headers != nil {
+		directives = append(directives, headers)
+	}
+
+	if encode := svc.encode(); encode != nil {
+		directives = append(directives, encode)
+	}
+
+	directives = append(directives, svc.limitDirectives()...)
+	directives = append(directives, svc.authDirectives()...)
+	directives = append(directives, svc.faultDirectives()...)
+	directives = append(directives, svc.rewriteDirectives()...)
+
+	if svc.StaticDir != nil {
+		return append(directives, svc.fileServer()...)
+	}
+
+	if len(svc.Stubs) > 0 {
+		return append(directives, svc.stubResponses()...)
+	}
+
+	return append(directives, c.reverseProxy(svc))
+}
+
+// listenPort returns the port caddy listens on for the service.
+func (c *Caddy) listenPort(svc *ServiceConfig) int32 {
+	if svc.ListenPort != 0 {
+		return svc.ListenPort
+	}
+
+	if c.servesTLS(svc) {
+		return httpsPort
+	}
+
+	return httpPort
+}
+
+// siteAddresses returns the caddy site addresses the service is served on.
+func (c *Caddy) siteAddresses(svc *ServiceConfig) []string {
+	port := c.listenPort(svc)
+	if !c.servesTLS(svc) {
+		if svc.Hostname == "" {
+			return []string{fmt.Sprintf(":%d", port)}
+		}
+
+		// http:// disables automatic https for the host name
+		return []string{siteAddress("http", svc.Hostname, port, httpPort)}
+	}
+
+	hostnames := c.siteHostnames(svc)
+	addresses := make([]string, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		addresses = append(addresses, siteAddress("https", hostname, port, httpsPort))
+	}
+
+	return addresses
+}
+
+func siteAddress(scheme, hostname string, port, defaultPort int32) string {
+	if port == defaultPort {
+		return scheme + "://" + hostname
+	}
+
+	return scheme + "://" + net.JoinHostPort(hostname, strconv.Itoa(int(port)))
+}
+
+func isCatchAllPath(path string) bool {
+	return path == "" || path == "/" || path == "*" || path == "/*"
+}
+
+// pathSpecificity ranks path matchers so that longer prefixes are matched
+// first, exact paths before wildcards of the same length, and the catch-all last.
+func pathSpecificity(path string) int {
+	if isCatchAllPath(path) {
+		return -1
+	}
+
+	if strings.HasSuffix(path, "*") {
+		return 2 * (len(path) - 1)
+	}
+
+	return 2*len(path) + 1
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dagger/caddy/internal/dagger"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestCaddyfile(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		caddy func(t *testing.T) *Caddy
+	}{
+		{
+			name: "multiple-services",
+			caddy: func(t *testing.T) *Caddy {
+				return New("caddy:2.8.4", "", nil).
+					WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+					WithService(ctx, nil, "frontend", 3000, 80, "/healthz", "10s", "2xx", "", 0, 0).
+					WithService(ctx, nil, "backend-pprof", 8080, 8081, "", "", "", "", 0, 0)
+			},
+		},
+		{
+			name: "shared-port",
+			caddy: func(t *testing.T) *Caddy {
+				return New("caddy:2.8.4", "", nil).
+					WithHostRoute(ctx, nil, "frontend.localhost", 3000, "").
+					WithHostRoute(ctx, nil, "backend.localhost", 8080, "backend").
+					WithPathRoute(ctx, nil, "backend", 8080, "/api/*", true, "").
+					WithPathRoute(ctx, nil, "backend", 8080, "/api/users", false, "").
+					WithPathRoute(ctx, nil, "frontend", 3000, "/", false, "").
+					WithPathRoute(ctx, nil, "docs", 8000, "/docs/*", false, "frontend.localhost")
+			},
+		},
+		{
+			name: "tls",
+			caddy: func(t *testing.T) *Caddy {
+				return New("caddy:2.8.4", "", nil).
+					WithPathRoute(ctx, nil, "backend", 8080, "/api/*", false, "").
+					WithPathRoute(ctx, nil, "frontend", 3000, "/", false, "").
+					WithHostRoute(ctx, nil, "app.example.com", 3000, "").
+					WithHostRoute(ctx, nil, "admin.example.com", 3000, "").
+					WithTLSCertificate(ctx, nil, nil, []string{"*.example.com"}).
+					WithInternalTLS(ctx, []string{"localhost", "caddy"})
+			},
+		},
+		{
+			name: "quoting",
+			caddy: func(t *testing.T) *Caddy {
+				c := New("caddy:2.8.4", "", nil).
+					WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+					WithPathRoute(ctx, nil, "backend", 8080, "/my files/*", false, "")
+				c = must(t)(c.WithRequestHeader(ctx, "backend", "X-Forwarded-User", "Jane Doe", "set"))
+				c = must(t)(c.WithResponseHeader(ctx, "backend", "Content-Security-Policy", `default-src 'self'; script-src "nonce"`, "set"))
+				c = must(t)(c.WithResponseHeader(ctx, "backend", "X-Comment", "#not-a-comment", "set"))
+				c = must(t)(c.WithResponseHeader(ctx, "backend", "X-Empty", "", "set"))
+				c = must(t)(c.WithResponseHeader(ctx, "backend", "X-Path", `C:\temp\`, "set"))
+				c = must(t)(c.WithResponseHeader(ctx, "backend", "X-Markdown", "`code` and \\\"", "set"))
+
+				return c
+			},
+		},
+		{
+			// caddy proxies websocket upgrades as long as the proxy neither
+			// buffers responses nor times out idle connections.
+			name: "streaming",
+			caddy: func(t *testing.T) *Caddy {
+				c := New("caddy:2.8.4", "", nil).
+					WithService(ctx, nil, "frontend", 3000, 0, "", "", "", "", 0, 0).
+					WithPathRoute(ctx, nil, "events", 8080, "/events/*", false, "")
+				c = must(t)(c.WithStreaming(ctx, "frontend", "-1", "", ""))
+				c = must(t)(c.WithStreaming(ctx, "events", "100ms", "1h", "1h"))
+
+				return c
+			},
+		},
+		{
+			name: "mirror",
+			caddy: func(t *testing.T) *Caddy {
+				c := New("caddy:2.8.4", "", nil).
+					WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+					WithAccessLog(ctx, "caddy-access-logs")
+				c = must(t)(c.WithMirror(ctx, "backend", nil, "backend-next", 8080))
+
+				return c
+			},
+		},
+		{
+			name: "faults",
+			caddy: func(t *testing.T) *Caddy {
+				c := New("caddy:2.8.4", "", nil).
+					WithService(ctx, nil, "backend", 8080, 0, "", "", "", "500ms", 10, 0).
+					WithService(ctx, nil, "frontend", 3000, 0, "", "", "", "", 0, 0).
+					WithAccessLog(ctx, "caddy-access-logs")
+				c = must(t)(c.WithFaults(ctx, "frontend", "", 25, 502, 5))
+
+				return c
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.caddy(t).caddyfile().String()
+
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != string(want) {
+				t.Errorf("caddyfile does not match %s, run go test -update to update it:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		caddy *Caddy
+		want  string
+	}{
+		{
+			name: "duplicate ports",
+			caddy: New("caddy:2.8.4", "", nil).
+				WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+				WithService(ctx, nil, "frontend", 3000, 8080, "", "", "", "", 0, 0),
+			want: `service "frontend": listen address :8080 is already used by "backend"`,
+		},
+		{
+			name: "special characters in upstream name",
+			caddy: New("caddy:2.8.4", "", nil).
+				WithService(ctx, nil, "my_backend", 8080, 0, "", "", "", "", 0, 0),
+			want: `service "my_backend": upstream name is not a valid DNS host name`,
+		},
+		{
+			name: "duplicate routes",
+			caddy: New("caddy:2.8.4", "", nil).
+				WithPathRoute(ctx, nil, "backend", 8080, "/api/*", false, "").
+				WithPathRoute(ctx, nil, "frontend", 3000, "/api/*", false, ""),
+			want: `service "frontend": route :80 /api/* is already used by "backend"`,
+		},
+		{
+			name: "latency with replicas",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithService(ctx, nil, "backend", 8080, 0, "", "", "", "500ms", 0, 0).
+				WithReplicas(ctx, "backend", []*dagger.Service{nil}, "cookie", "", 0)),
+			want: `service "backend": latency can't be combined with replicas, load balancing or health checks`,
+		},
+		{
+			name: "certificate without host routes",
+			caddy: New("caddy:2.8.4", "", nil).
+				WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+				WithTLSCertificate(ctx, nil, nil, []string{"localhost"}),
+			want: `certificate #1: no site uses it`,
+		},
+		{
+			name: "health check on a static site",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithStaticSite(ctx, dag.Directory(), 3000, false, "").
+				WithHealthCheck(ctx, "static-3000", "/healthz", "10s", "2xx")),
+			want: `service "static-3000": health checks can only be used on proxied routes`,
+		},
+		{
+			name: "replicas of a stub route",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithStubRoute(ctx, "/api/users", 200, `[]`, nil, "", "", 0).
+				WithReplicas(ctx, "stubs", []*dagger.Service{nil}, "", "", 0)),
+			want: `service "stubs": replicas and load balancing can only be used on proxied routes`,
+		},
+		{
+			name: "upstream protocol of a stub route",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithStubRoute(ctx, "/api/users", 200, `[]`, nil, "", "", 0).
+				WithUpstreamProtocol(ctx, "stubs", "h2c")),
+			want: `service "stubs": upstream protocols can only be set on proxied routes`,
+		},
+		{
+			name: "streaming stub route",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithStubRoute(ctx, "/api/users", 200, `[]`, nil, "", "", 0).
+				WithStreaming(ctx, "stubs", "-1", "", "")),
+			want: `service "stubs": streaming options can only be set on proxied routes`,
+		},
+		{
+			name: "request header on a stub route",
+			caddy: must(t)(New("caddy:2.8.4", "", nil).
+				WithStubRoute(ctx, "/api/users", 200, `[]`, nil, "", "", 0).
+				WithRequestHeader(ctx, "stubs", "X-Forwarded-User", "jane", "set")),
+			want: `service "stubs": request header "X-Forwarded-User" can only be set on proxied routes`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.caddy.Validate(ctx)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// must returns a function failing the test if a modifier returned an error.
+func must(t *testing.T) func(*Caddy, error) *Caddy {
+	t.Helper()
+
+	return func(c *Caddy, err error) *Caddy {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "context"
+
+// contentEncodings are the compression formats caddy can encode responses with.
+var contentEncodings = []string{"zstd", "gzip"}
+
+// WithCompression compresses the responses of the routes to the named upstream
+// for clients accepting one of the given encodings.
+func (c *Caddy) WithCompression(
+	ctx context.Context,
+	// The upstream name of the routes to compress.
+	upstreamName string,
+	// The encodings in order of preference, zstd and/or gzip.
+	//
+	// +default=["zstd", "gzip"]
+	encodings []string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Encodings = encodings
+	})
+}
+
+// encode returns the directive compressing the route's responses, or nil if
+// they are not compressed.
+func (svc *ServiceConfig) encode() *directive {
+	if len(svc.Encodings) == 0 {
+		return nil
+	}
+
+	return newDirective("encode", svc.Encodings...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// Export returns the configuration caddy is run with, e.g. to compare it
+// against the configuration deployed elsewhere.
+func (c *Caddy) Export(
+	ctx context.Context,
+	// The format to export, either caddyfile or json (caddy's native config,
+	// as produced by caddy adapt).
+	//
+	// +default="caddyfile"
+	format string,
+) (*dagger.File, error) {
+	if err := c.Validate(ctx); err != nil {
+		return nil, err
+	}
+
+	caddyFile, err := c.GetCaddyFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "caddyfile":
+		return dag.Directory().
+			WithNewFile("Caddyfile", caddyFile).
+			File("Caddyfile"), nil
+	case "json":
+		return c.base().
+			WithNewFile(caddyfilePath, caddyFile).
+			WithExec([]string{"caddy", "adapt", "--config", caddyfilePath, "--adapter", "caddyfile", "--pretty"}, dagger.ContainerWithExecOpts{
+				RedirectStdout: "/opt/caddy/caddy.json",
+			}).
+			File("/opt/caddy/caddy.json"), nil
+	}
+
+	return nil, fmt.Errorf("unknown export format %q, expected caddyfile or json", format)
+}
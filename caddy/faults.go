@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Faults are failures injected into the requests of a route.
+type Faults struct {
+	// Latency delays every request, e.g. 500ms
+	Latency string
+
+	// ErrorPercent of the requests are answered with ErrorStatus instead of
+	// being proxied.
+	ErrorPercent int
+	ErrorStatus  int
+
+	// DropPercent of the requests have their connection closed without
+	// a response.
+	DropPercent int
+}
+
+// WithFaults injects latency, errors and dropped connections into the
+// requests to the named upstream, to test how clients cope with a slow or
+// flaky service. Caddy is built with the caddy-l4 plugin to delay requests.
+//
+// Latency is injected by a layer4 hop in front of the upstream, so it can't
+// be combined with replicas, load balancing or health checks.
+func (c *Caddy) WithFaults(
+	ctx context.Context,
+	// The upstream name of the routes to inject faults into.
+	upstreamName string,
+	// Delay every request by this duration, e.g. 500ms
+	//
+	// +optional
+	latency string,
+	// The percentage of requests answered with errorStatus.
+	//
+	// +optional
+	errorPercent int,
+	// The status of the injected errors.
+	//
+	// +default=503
+	errorStatus int,
+	// The percentage of requests whose connection is closed without a response.
+	//
+	// +optional
+	dropPercent int,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Faults = newFaults(latency, errorPercent, errorStatus, dropPercent)
+	})
+}
+
+// newFaults returns the faults to inject, or nil if there are none.
+func newFaults(latency string, errorPercent, errorStatus, dropPercent int) *Faults {
+	if latency == "" && errorPercent == 0 && dropPercent == 0 {
+		return nil
+	}
+
+	return &Faults{
+		Latency:      latency,
+		ErrorPercent: errorPercent,
+		ErrorStatus:  errorStatus,
+		DropPercent:  dropPercent,
+	}
+}
+
+// faultDirectives returns the directives failing a share of the route's
+// requests, if any.
+func (svc *ServiceConfig) faultDirectives() []*directive {
+	faults := svc.Faults
+	if faults == nil {
+		return nil
+	}
+
+	// the request's random UUID picks which requests fail: errors take the
+	// first ErrorPercent of its range, drops the DropPercent after them.
+	var directives []*directive
+	if faults.ErrorPercent > 0 {
+		directives = append(directives,
+			newDirective("@fault_error", "vars_regexp", "{http.request.uuid}", uuidRangeRegexp(0, faults.ErrorPercent)),
+			newDirective("error", "@fault_error", "injected fault", strconv.Itoa(faults.ErrorStatus)),
+		)
+	}
+
+	if faults.DropPercent > 0 {
+		directives = append(directives,
+			newDirective("@fault_drop", "vars_regexp", "{http.request.uuid}", uuidRangeRegexp(faults.ErrorPercent, faults.ErrorPercent+faults.DropPercent)),
+			newDirective("abort", "@fault_drop"),
+		)
+	}
+
+	return directives
+}
+
+// uuidRangeRegexp returns a regular expression matching the UUIDs whose first
+// byte falls within the given percentiles of its range.
+func uuidRangeRegexp(fromPercent, toPercent int) string {
+	from, to := fromPercent*256/100, toPercent*256/100
+
+	var alternatives []string
+	for high := from >> 4; high <= (to-1)>>4 && from < to; high++ {
+		low, lowEnd := 0, 15
+		if high == from>>4 {
+			low = from & 15
+		}
+
+		if high == (to-1)>>4 {
+			lowEnd = (to - 1) & 15
+		}
+
+		alternatives = append(alternatives, fmt.Sprintf("%x%s", high, nibbleClass(low, lowEnd)))
+	}
+
+	return "^(" + strings.Join(alternatives, "|") + ")"
+}
+
+// nibbleClass returns a character class matching the hex digits from low to high.
+func nibbleClass(low, high int) string {
+	if low == high {
+		return fmt.Sprintf("%x", low)
+	}
+
+	var class string
+	if low <= 9 {
+		class += fmt.Sprintf("%d-%d", low, min(high, 9))
+	}
+
+	if high >= 10 {
+		class += fmt.Sprintf("%x-%x", max(low, 10), high)
+	}
+
+	return "[" + class + "]"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// HeaderRule is an operation on a request or response header of a route.
+type HeaderRule struct {
+	// Response applies the rule to responses instead of requests.
+	Response bool
+	// Operation is one of set, add or remove.
+	Operation string
+	Name      string
+	Value     string
+}
+
+// WithRequestHeader sets, adds or removes a header of the requests proxied to
+// the named upstream, e.g. to inject X-Forwarded-User for local auth. Static
+// sites and stub routes are not proxied, so they can't have request headers.
+func (c *Caddy) WithRequestHeader(
+	ctx context.Context,
+	// The upstream name of the routes to apply the rule to.
+	upstreamName string,
+	name string,
+	// The header value, not used when removing the header, and possibly empty
+	// when setting it. Caddy placeholders like {http.request.remote.host} can
+	// be used.
+	//
+	// +optional
+	value string,
+	// One of set, add or remove.
+	//
+	// +default="set"
+	operation string,
+) (*Caddy, error) {
+	return c.withHeaderRule(upstreamName, &HeaderRule{
+		Operation: operation,
+		Name:      name,
+		Value:     value,
+	})
+}
+
+// WithResponseHeader sets, adds or removes a header of the responses of the
+// routes to the named upstream, e.g. to add CORS headers. The rule is applied
+// to responses generated by caddy as well, like a 502 when the upstream is down.
+func (c *Caddy) WithResponseHeader(
+	ctx context.Context,
+	// The upstream name of the routes to apply the rule to.
+	upstreamName string,
+	name string,
+	// The header value, not used when removing the header, and possibly empty
+	// when setting it.
+	//
+	// +optional
+	value string,
+	// One of set, add or remove.
+	//
+	// +default="set"
+	operation string,
+) (*Caddy, error) {
+	return c.withHeaderRule(upstreamName, &HeaderRule{
+		Response:  true,
+		Operation: operation,
+		Name:      name,
+		Value:     value,
+	})
+}
+
+func (c *Caddy) withHeaderRule(upstreamName string, rule *HeaderRule) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Headers = append(svc.Headers, rule)
+	})
+}
+
+// responseHeaders returns the header directive applying the route's response
+// header rules, or nil if there are none.
+func (svc *ServiceConfig) responseHeaders() *directive {
+	header := newDirective("header")
+	for _, rule := range svc.Headers {
+		if rule.Response {
+			field := rule.field()
+			header.withBlock(newDirective(field[0], field[1:]...))
+		}
+	}
+
+	if len(header.Block) == 0 {
+		return nil
+	}
+
+	// apply the rules after the upstream responded, so they win over its headers.
+	return header.withBlock(newDirective("defer"))
+}
+
+// field returns the caddy header field arguments for the rule.
+func (rule *HeaderRule) field() []string {
+	switch rule.Operation {
+	case "add":
+		return []string{"+" + rule.Name, rule.Value}
+	case "remove":
+		return []string{"-" + rule.Name}
+	default:
+		return []string{rule.Name, rule.Value}
+	}
+}
+
+func (rule *HeaderRule) validate() string {
+	switch {
+	case rule.Operation != "set" && rule.Operation != "add" && rule.Operation != "remove":
+		return fmt.Sprintf("unknown header operation %q", rule.Operation)
+	case rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n:"):
+		return fmt.Sprintf("invalid header name %q", rule.Name)
+	case rule.Operation == "add" && rule.Value == "":
+		return fmt.Sprintf("header %q has no value to add", rule.Name)
+	}
+
+	return ""
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestHeaderRuleValidate(t *testing.T) {
+	tests := []struct {
+		rule *HeaderRule
+		want string
+	}{
+		{rule: &HeaderRule{Operation: "set", Name: "X-Empty"}},
+		{rule: &HeaderRule{Operation: "remove", Name: "Server"}},
+		{rule: &HeaderRule{Operation: "add", Name: "X-Empty"}, want: `header "X-Empty" has no value to add`},
+		{rule: &HeaderRule{Operation: "replace", Name: "X-Name", Value: "value"}, want: `unknown header operation "replace"`},
+		{rule: &HeaderRule{Operation: "set", Name: "X-Name:", Value: "value"}, want: `invalid header name "X-Name:"`},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.validate(); got != tt.want {
+			t.Errorf("validate(%+v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// readinessAlias is the name the caddy service is bound as when checking readiness.
+const readinessAlias = "caddy"
+
+// WithHealthCheck actively health checks the instances of the named upstream.
+// Unhealthy instances are not proxied to until they pass the check again.
+func (c *Caddy) WithHealthCheck(
+	ctx context.Context,
+	// The upstream name of the routes to health check.
+	upstreamName string,
+	// The upstream path to request, e.g. /healthz
+	path string,
+	// How often to run the health check.
+	//
+	// +default="10s"
+	interval string,
+	// The status code expected from the health check, e.g. 200 or 2xx
+	//
+	// +default="2xx"
+	status string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.HealthPath = path
+		svc.HealthInterval = interval
+		svc.HealthStatus = status
+	})
+}
+
+// WaitReady starts caddy and waits until every route responds through the
+// proxy and every upstream instance is ready, returning the running service.
+//
+// Routes with a health check must return the expected status for their health
+// path, both through the proxy and from each upstream instance, as caddy only
+// proxies to the instances passing it. Through the proxy, the health path of
+// routes with basic or forward auth may also answer 401 or 403. Other routes
+// must return any status that is not a server error.
+func (c *Caddy) WaitReady(
+	ctx context.Context,
+	// How long to wait for all routes to become ready.
+	//
+	// +default="60s"
+	timeout string,
+) (*dagger.Service, error) {
+	deadline, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout %q: %w", timeout, err)
+	}
+
+	svc, err := c.Serve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err = svc.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctr := dag.Container().
+		From("curlimages/curl:8.10.1").
+		WithServiceBinding(readinessAlias, svc)
+
+	script := []string{
+		fmt.Sprintf("end=$(( $(date +%%s) + %d ))", int(deadline.Seconds())),
+	}
+
+	bound := map[string]bool{}
+	for _, route := range c.Services {
+		script = append(script, c.readinessCheck(route))
+
+		for _, u := range route.upstreams() {
+			script = append(script, route.instanceCheck(u.name))
+			if !bound[u.name] {
+				ctr = ctr.WithServiceBinding(u.name, u.svc)
+				bound[u.name] = true
+			}
+		}
+	}
+
+	_, err = ctr.
+		// a cached result would skip polling the freshly started service
+		WithEnvVariable("CACHEBUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", strings.Join(script, "\n")}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("caddy routes did not become ready within %s: %w", timeout, err)
+	}
+
+	return svc, nil
+}
+
+// readinessCheck returns a shell snippet polling the route through the proxy
+// until it responds with the expected status, or the deadline passes.
+func (c *Caddy) readinessCheck(svc *ServiceConfig) string {
+	port := strconv.Itoa(int(c.listenPort(svc)))
+
+	scheme, hostname := "http", readinessAlias
+	if c.servesTLS(svc) {
+		scheme, hostname = "https", c.siteHostnames(svc)[0]
+	} else if svc.Hostname != "" {
+		hostname = svc.Hostname
+	}
+
+	// caddy answers 502/503 as long as the upstream is unreachable or unhealthy.
+	path, expected := svc.readinessPath(), "[1-4]??"
+	if svc.HealthPath != "" {
+		expected = strings.ReplaceAll(svc.HealthStatus, "x", "?")
+
+		// the health path is protected as well, and caddy only checks
+		// authentication once the upstream is reachable.
+		if len(svc.BasicAuth) > 0 || svc.ForwardAuth != nil {
+			expected += "|401|403"
+		}
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(hostname, port), path)
+	connectTo := fmt.Sprintf("%s:%s:%s:%s", hostname, port, readinessAlias, port)
+
+	return poll(url, expected, "--connect-to", connectTo)
+}
+
+// instanceCheck returns a shell snippet polling an upstream instance of the
+// route directly until it responds with the expected status, or the deadline
+// passes.
+func (svc *ServiceConfig) instanceCheck(instance string) string {
+	scheme, path, expected := "http", "/", "[1-4]??"
+	if svc.HealthPath != "" {
+		path, expected = svc.HealthPath, strings.ReplaceAll(svc.HealthStatus, "x", "?")
+	}
+
+	var args []string
+	switch svc.UpstreamProtocol {
+	case "h2c":
+		args = append(args, "--http2-prior-knowledge")
+	case "https-insecure":
+		scheme = "https"
+	}
+
+	url := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(instance, strconv.Itoa(int(svc.UpstreamPort))), path)
+
+	return poll(url, expected, args...)
+}
+
+// poll returns a shell snippet requesting the url until it responds with a
+// status matching the expected case pattern, or the deadline passes.
+func poll(url, expected string, curlArgs ...string) string {
+	args := []string{"-ks", "-o", "/dev/null", "-w", "%{http_code}"}
+	args = append(args, curlArgs...)
+
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append(args, url) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return fmt.Sprintf(`until case "$(curl %s)" in %s) true;; *) false;; esac; do
+	[ "$(date +%%s)" -lt "$end" ] || { echo %s >&2; exit 1; }
+	sleep 1
+done`, strings.Join(quoted, " "), expected, shellQuote(url+" is not ready"))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// readinessPath returns the path requested through the proxy to check that
+// the route is ready.
+func (svc *ServiceConfig) readinessPath() string {
+	prefix := "/"
+	if !isCatchAllPath(svc.Path) {
+		prefix = strings.TrimSuffix(svc.Path, "*")
+	}
+
+	if svc.HealthPath == "" {
+		return prefix
+	}
+
+	if svc.StripPrefix {
+		return strings.TrimSuffix(prefix, "/") + svc.HealthPath
+	}
+
+	return svc.HealthPath
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"dagger/caddy/internal/dagger"
+)
+
+func TestInstanceChecks(t *testing.T) {
+	ctx := context.Background()
+
+	c := must(t)(New("caddy:2.8.4", "", nil).
+		WithService(ctx, nil, "backend", 8080, 0, "/healthz", "10s", "2xx", "", 0, 0).
+		WithReplicas(ctx, "backend", []*dagger.Service{nil, nil}, "round_robin", "", 0))
+
+	svc := c.Services[0]
+	for _, want := range []string{"backend", "backend-replica-1", "backend-replica-2"} {
+		check := svc.instanceCheck(want)
+		if url := "'http://" + want + ":8080/healthz'"; !strings.Contains(check, url) {
+			t.Errorf("instance check of %s does not request %s:\n%s", want, url, check)
+		}
+
+		if !strings.Contains(check, " in 2??) true") {
+			t.Errorf("instance check of %s does not expect 2xx:\n%s", want, check)
+		}
+	}
+}
+
+func TestReadinessCheckOfProtectedRoute(t *testing.T) {
+	ctx := context.Background()
+
+	c := must(t)(New("caddy:2.8.4", "", nil).
+		WithService(ctx, nil, "backend", 8080, 0, "/healthz", "10s", "200", "", 0, 0).
+		WithForwardAuth(ctx, "backend", nil, "auth", 9091, "/", nil))
+
+	check := c.readinessCheck(c.Services[0])
+	if !strings.Contains(check, " in 200|401|403) true") {
+		t.Errorf("readiness check of a protected route does not accept 401 and 403:\n%s", check)
+	}
+}
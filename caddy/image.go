@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// caddyBinary is where the caddy binary lives in the official image.
+const caddyBinary = "/usr/bin/caddy"
+
+// base returns the caddy image, with a custom caddy binary including the
+// configured plugins when there are any.
+func (c *Caddy) base() *dagger.Container {
+	ctr := dag.Container().From(c.imageRef())
+	plugins := c.plugins()
+	if len(plugins) == 0 {
+		return ctr
+	}
+
+	args := []string{"xcaddy", "build", "--output", "/tmp/caddy"}
+	for _, plugin := range plugins {
+		args = append(args, "--with", plugin)
+	}
+
+	binary := dag.Container().
+		From(c.builderImage()).
+		WithExec(args).
+		File("/tmp/caddy")
+
+	return ctr.WithFile(caddyBinary, binary)
+}
+
+// plugins returns the configured plugins, plus the ones required by the
+// configured features.
+func (c *Caddy) plugins() []string {
+	plugins := append([]string(nil), c.Plugins...)
+	if c.usesL4() && !hasPlugin(plugins, l4Plugin) {
+		plugins = append(plugins, l4Plugin)
+	}
+
+	if c.usesRateLimits() && !hasPlugin(plugins, rateLimitPlugin) {
+		plugins = append(plugins, rateLimitPlugin)
+	}
+
+	return plugins
+}
+
+// hasPlugin reports whether the module, possibly pinned to a version
+// (e.g. module@v1.2.3), is in the list of plugins.
+func hasPlugin(plugins []string, module string) bool {
+	for _, plugin := range plugins {
+		if name, _, _ := strings.Cut(plugin, "@"); name == module {
+			return true
+		}
+	}
+
+	return false
+}
+
+// imageRef returns the image reference, pinned to the digest if there is one.
+func (c *Caddy) imageRef() string {
+	if c.Digest == "" {
+		return c.Image
+	}
+
+	return c.Image + "@" + c.Digest
+}
+
+// builderImage returns the official xcaddy builder image matching the
+// image's caddy version, e.g. caddy:2.8.4-builder for caddy:2.8.4
+func (c *Caddy) builderImage() string {
+	tag := "latest"
+	if i := strings.LastIndex(c.Image, ":"); i > strings.LastIndex(c.Image, "/") {
+		tag = c.Image[i+1:]
+	}
+
+	if tag == "latest" {
+		return c.imageRepository() + ":builder"
+	}
+
+	return c.imageRepository() + ":" + tag + "-builder"
+}
+
+// imageRepository returns the image without its tag.
+func (c *Caddy) imageRepository() string {
+	if i := strings.LastIndex(c.Image, ":"); i > strings.LastIndex(c.Image, "/") {
+		return c.Image[:i]
+	}
+
+	return c.Image
+}
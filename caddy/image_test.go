@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestPlugins(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		caddy *Caddy
+		want  []string
+	}{
+		{
+			name: "required plugin",
+			caddy: New("caddy:2.8.4", "", nil).
+				WithTCPService(ctx, nil, "db", 5432, 0),
+			want: []string{l4Plugin},
+		},
+		{
+			name: "pinned required plugin",
+			caddy: New("caddy:2.8.4", "", []string{l4Plugin + "@v1.2.3"}).
+				WithTCPService(ctx, nil, "db", 5432, 0),
+			want: []string{l4Plugin + "@v1.2.3"},
+		},
+		{
+			name: "pinned rate limit plugin",
+			caddy: must(t)(New("caddy:2.8.4", "", []string{rateLimitPlugin + "@v1.2.3"}).
+				WithService(ctx, nil, "backend", 8080, 0, "", "", "", "", 0, 0).
+				WithRateLimit(ctx, "backend", 100, "1m", "{remote_host}")),
+			want: []string{rateLimitPlugin + "@v1.2.3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.caddy.plugins(); !slices.Equal(got, tt.want) {
+				t.Errorf("plugins() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
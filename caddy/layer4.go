@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// l4Plugin is the caddy plugin proxying TCP and UDP. It is built at its latest
+// version, unless the configured plugins pin it, e.g. to module@v1.2.3
+const l4Plugin = "github.com/mholt/caddy-l4"
+
+// hopPortBase is the first loopback port used by routes whose connections
+// go through layer4 handlers on their way to the upstreams.
+const hopPortBase = 19000
+
+// L4Service is a service proxied at the TCP or UDP layer.
+type L4Service struct {
+	// Protocol is either tcp or udp.
+	Protocol     string
+	UpstreamName string
+	UpstreamPort int32
+	UpstreamSvc  *dagger.Service
+	ListenPort   int32
+}
+
+// WithTCPService proxies raw TCP connections to the upstream service, e.g. a
+// database or a gRPC service. Caddy is built with the caddy-l4 plugin for it.
+func (c *Caddy) WithTCPService(
+	ctx context.Context,
+	upstreamService *dagger.Service,
+	upstreamName string,
+	upstreamPort int32,
+	// The port caddy listens on for this service.
+	//
+	// Defaults to the upstream port.
+	//
+	// +optional
+	listenPort int32,
+) *Caddy {
+	return c.withL4Service("tcp", upstreamService, upstreamName, upstreamPort, listenPort)
+}
+
+// WithUDPService proxies UDP datagrams to the upstream service. Caddy is built
+// with the caddy-l4 plugin for it.
+func (c *Caddy) WithUDPService(
+	ctx context.Context,
+	upstreamService *dagger.Service,
+	upstreamName string,
+	upstreamPort int32,
+	// The port caddy listens on for this service.
+	//
+	// Defaults to the upstream port.
+	//
+	// +optional
+	listenPort int32,
+) *Caddy {
+	return c.withL4Service("udp", upstreamService, upstreamName, upstreamPort, listenPort)
+}
+
+func (c *Caddy) withL4Service(protocol string, upstreamService *dagger.Service, upstreamName string, upstreamPort, listenPort int32) *Caddy {
+	if listenPort == 0 {
+		listenPort = upstreamPort
+	}
+
+	c.L4Services = append(c.L4Services, &L4Service{
+		Protocol:     protocol,
+		UpstreamName: upstreamName,
+		UpstreamPort: upstreamPort,
+		UpstreamSvc:  upstreamService,
+		ListenPort:   listenPort,
+	})
+
+	return c
+}
+
+// layer4 returns the global option configuring the caddy-l4 app.
+func (c *Caddy) layer4() *directive {
+	layer4 := newDirective("layer4")
+	for _, svc := range c.L4Services {
+		layer4.withBlock(
+			newDirective(svc.listenAddress()).withBlock(
+				newDirective("route").withBlock(
+					newDirective("proxy", svc.upstreamAddress()),
+				),
+			),
+		)
+	}
+
+	return layer4.withBlock(c.hops()...)
+}
+
+// usesL4 reports whether caddy needs the caddy-l4 plugin.
+func (c *Caddy) usesL4() bool {
+	if len(c.L4Services) > 0 {
+		return true
+	}
+
+	for _, svc := range c.Services {
+		if svc.hasHop() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasHop reports whether the route's connections go through layer4, to
+// inject latency into them or mirror them.
+func (svc *ServiceConfig) hasHop() bool {
+	return (svc.Faults != nil && svc.Faults.Latency != "") || svc.Mirror != nil
+}
+
+// balanced reports whether the route load balances or health checks its
+// upstream instances, which caddy can't do through a layer4 hop as it only
+// sees the hop.
+func (svc *ServiceConfig) balanced() bool {
+	return len(svc.Replicas) > 0 || svc.LBPolicy != "" ||
+		svc.FailDuration != "" || svc.MaxFails > 0 || svc.HealthPath != ""
+}
+
+// hopPort returns the loopback port the route's connections go through, or
+// 0 if they go to the upstreams directly.
+func (c *Caddy) hopPort(svc *ServiceConfig) int32 {
+	port := int32(hopPortBase)
+	for _, other := range c.Services {
+		if !other.hasHop() {
+			continue
+		}
+
+		if other == svc {
+			return port
+		}
+		port++
+	}
+
+	return 0
+}
+
+// hops returns the layer4 servers handling the connections of the routes
+// with a hop, before proxying them to the upstreams.
+func (c *Caddy) hops() []*directive {
+	var servers []*directive
+	for _, svc := range c.Services {
+		port := c.hopPort(svc)
+		if port == 0 {
+			continue
+		}
+
+		route := newDirective("route")
+		if svc.Faults != nil && svc.Faults.Latency != "" {
+			route.withBlock(newDirective("throttle").withBlock(newDirective("latency", svc.Faults.Latency)))
+		}
+
+		if svc.Mirror != nil {
+			// the copy's responses are discarded by tee.
+			route.withBlock(newDirective("tee").withBlock(
+				newDirective("proxy", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(c.mirrorPort(svc))))),
+			))
+		}
+
+		// routes with a hop have no replicas, see Validate.
+		proxy := newDirective("proxy", net.JoinHostPort(svc.UpstreamName, strconv.Itoa(int(svc.UpstreamPort))))
+		servers = append(servers, newDirective(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))).withBlock(
+			route.withBlock(proxy),
+		))
+	}
+
+	return servers
+}
+
+// listenAddress returns the caddy-l4 address the service is served on.
+func (svc *L4Service) listenAddress() string {
+	address := fmt.Sprintf(":%d", svc.ListenPort)
+	if svc.Protocol == "udp" {
+		return "udp/" + address
+	}
+
+	return address
+}
+
+// upstreamAddress returns the caddy-l4 address the service is proxied to.
+func (svc *L4Service) upstreamAddress() string {
+	address := net.JoinHostPort(svc.UpstreamName, strconv.Itoa(int(svc.UpstreamPort)))
+	if svc.Protocol == "udp" {
+		return "udp/" + address
+	}
+
+	return address
+}
+
+func (svc *L4Service) networkProtocol() dagger.NetworkProtocol {
+	if svc.Protocol == "udp" {
+		return dagger.NetworkProtocolUdp
+	}
+
+	return dagger.NetworkProtocolTcp
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+// rateLimitPlugin is the caddy plugin providing the rate_limit directive. It
+// is built at its latest version, unless the configured plugins pin it.
+const rateLimitPlugin = "github.com/mholt/caddy-ratelimit"
+
+// RateLimit allows a number of requests per window for each key.
+type RateLimit struct {
+	Events int
+	Window string
+	// Key is the caddy placeholder requests are grouped by.
+	Key string
+}
+
+// WithMaxRequestBody rejects requests to the named upstream with a body
+// larger than the given size with 413 Request Entity Too Large.
+func (c *Caddy) WithMaxRequestBody(
+	ctx context.Context,
+	// The upstream name of the routes to limit.
+	upstreamName string,
+	// The maximum body size, e.g. 10MB
+	maxSize string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.MaxRequestBody = maxSize
+	})
+}
+
+// WithRateLimit rejects requests to the named upstream exceeding the given rate
+// with 429 Too Many Requests. Caddy is built with the caddy-ratelimit plugin for it.
+func (c *Caddy) WithRateLimit(
+	ctx context.Context,
+	// The upstream name of the routes to limit.
+	upstreamName string,
+	// The number of requests allowed per window.
+	events int,
+	// The sliding window, e.g. 1m
+	//
+	// +default="1m"
+	window string,
+	// The caddy placeholder requests are grouped by, e.g. {http.request.header.Authorization}
+	//
+	// +default="{remote_host}"
+	key string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.RateLimit = &RateLimit{
+			Events: events,
+			Window: window,
+			Key:    key,
+		}
+	})
+}
+
+// usesRateLimits reports whether any route is rate limited.
+func (c *Caddy) usesRateLimits() bool {
+	for _, svc := range c.Services {
+		if svc.RateLimit != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limitDirectives returns the directives limiting the route's requests, if any.
+func (svc *ServiceConfig) limitDirectives() []*directive {
+	var directives []*directive
+	if svc.MaxRequestBody != "" {
+		directives = append(directives, newDirective("request_body").withBlock(
+			newDirective("max_size", svc.MaxRequestBody),
+		))
+	}
+
+	if limit := svc.RateLimit; limit != nil {
+		// routes to the same upstream share the zone, and so the limit.
+		directives = append(directives, newDirective("rate_limit").withBlock(
+			newDirective("zone", svc.UpstreamName).withBlock(
+				newDirective("key", limit.Key),
+				newDirective("events", strconv.Itoa(limit.Events)),
+				newDirective("window", limit.Window),
+			),
+		))
+	}
+
+	return directives
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"dagger/caddy/internal/dagger"
+)
+
+const (
+	// accessLogDir is where the access log volume is mounted in the container.
+	accessLogDir = "/var/log/caddy"
+
+	// upstreamHeader is the response header telling which upstream instance
+	// served a request, when access logs are enabled.
+	upstreamHeader = "X-Caddy-Upstream"
+)
+
+var accessLogPath = path.Join(accessLogDir, "access.log")
+
+// WithAccessLog writes JSON access logs of all sites, which can be retrieved
+// with AccessLogs after a run. Proxied responses carry an X-Caddy-Upstream
+// header, so the logs show which upstream instance served each request.
+func (c *Caddy) WithAccessLog(
+	ctx context.Context,
+	// The cache volume the logs are written to. Use different volumes for
+	// proxies running concurrently.
+	//
+	// +default="caddy-access-logs"
+	volume string,
+) *Caddy {
+	c.AccessLog = true
+	c.AccessLogVolume = volume
+
+	return c
+}
+
+// AccessLogs returns the access logs written by the last caddy run, one JSON
+// object per line.
+func (c *Caddy) AccessLogs(ctx context.Context) (*dagger.File, error) {
+	if !c.AccessLog {
+		return nil, fmt.Errorf("access logs are not enabled, use with-access-log first")
+	}
+
+	return dag.Container().
+		From("alpine:3.20").
+		WithMountedCache(accessLogDir, dag.CacheVolume(c.AccessLogVolume)).
+		// the logs change with every run, so never use a cached copy
+		WithEnvVariable("CACHEBUSTER", time.Now().String()).
+		WithExec([]string{"sh", "-c", "cp " + accessLogPath + " /access.log || touch /access.log"}).
+		File("/access.log"), nil
+}
+
+func accessLog() *directive {
+	return newDirective("log").withBlock(
+		newDirective("output", "file", accessLogPath),
+		newDirective("format", "json"),
+	)
+}
@@ -3,62 +3,400 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"dagger/caddy/internal/dagger"
 )
 
+// caddyfilePath is where the generated Caddyfile is written in the container.
+const caddyfilePath = "/opt/caddy/caddyfile"
+
+const (
+	// httpPort and httpsPort are the ports on which all host and path
+	// based routes are served, depending on whether TLS is enabled.
+	httpPort  = 80
+	httpsPort = 443
+)
+
 type Caddy struct {
+	Image   string
+	Digest  string
+	Plugins []string
+
 	Services []*ServiceConfig
+
+	// InternalTLS terminates https on all sites using caddy's internal issuer.
+	InternalTLS bool
+
+	// TLSHostnames are the host names certificates are issued for on
+	// sites that are not routed by host name.
+	TLSHostnames []string
+
+	// LocalCA holds the root certificate (root.crt) and key (root.key)
+	// used by the internal issuer.
+	LocalCA *dagger.Directory
+
+	// Certificates are user provided certificates, used instead of the
+	// internal issuer for the host names they cover.
+	Certificates []*Certificate
+
+	// AccessLog writes JSON access logs of all sites to the cache volume
+	// AccessLogVolume.
+	AccessLog       bool
+	AccessLogVolume string
+
+	// CustomCaddyfile, when set, is used instead of the generated Caddyfile.
+	CustomCaddyfile *dagger.File
+
+	// GlobalSnippets are raw Caddyfile snippets added to the global options.
+	GlobalSnippets []string
+
+	// Metrics exposes caddy's prometheus metrics on MetricsPort.
+	Metrics     bool
+	MetricsPort int32
+
+	// L4Services are proxied at the TCP/UDP layer using the caddy-l4 plugin.
+	L4Services []*L4Service
 }
 
 type ServiceConfig struct {
+	// UpstreamName is the name the upstream service is bound as. For static
+	// sites, it only names the route.
 	UpstreamName string
 	UpstreamPort int32
 	UpstreamSvc  *dagger.Service
+
+	// ListenPort is the port caddy listens on for this service. Host and
+	// path based routes leave it unset to share the default http(s) port.
+	ListenPort int32
+
+	// Hostname, when set, makes caddy route requests for this host name
+	// on ListenPort to the upstream.
+	Hostname string
+
+	// Path, when set, is the caddy path matcher (e.g. /api/*) for which
+	// requests on ListenPort are routed to the upstream. "/" matches everything
+	// not matched by a more specific path.
+	Path string
+
+	// StripPrefix removes the matched path prefix before proxying.
+	StripPrefix bool
+
+	// UpstreamProtocol is how caddy talks to the upstream: http, h2c
+	// (cleartext HTTP/2, e.g. gRPC) or https-insecure (https without
+	// verifying the upstream's certificate). Defaults to http.
+	UpstreamProtocol string
+
+	// FlushInterval, ReadTimeout and WriteTimeout tune the proxy for
+	// long lived streams like websockets and server-sent events.
+	FlushInterval string
+	ReadTimeout   string
+	WriteTimeout  string
+
+	// Replicas are additional instances of UpstreamSvc, load balanced
+	// using LBPolicy.
+	Replicas []*dagger.Service
+	LBPolicy string
+
+	// FailDuration and MaxFails configure passive health checks of the
+	// upstream instances.
+	FailDuration string
+	MaxFails     int
+
+	// HealthPath, HealthInterval and HealthStatus configure active health
+	// checks of the upstream instances.
+	HealthPath     string
+	HealthInterval string
+	HealthStatus   string
+
+	// Headers are manipulations of the request and response headers.
+	Headers []*HeaderRule
+
+	// MaxRequestBody limits the size of request bodies, e.g. 10MB
+	MaxRequestBody string
+
+	// RateLimit limits the rate of requests to the route.
+	RateLimit *RateLimit
+
+	// BasicAuth and ForwardAuth protect the route.
+	BasicAuth   []*BasicAuthUser
+	ForwardAuth *ForwardAuth
+
+	// Faults are injected into the route's requests.
+	Faults *Faults
+
+	// HTTPSRedirect redirects plain http requests on port 80 to the route.
+	HTTPSRedirect bool
+
+	// HostAliases are host names redirected to Hostname.
+	HostAliases []string
+
+	// Rewrites are applied to the route's requests before they are handled.
+	Rewrites []*Rewrite
+
+	// Encodings the route's responses are compressed with, e.g. zstd and gzip.
+	Encodings []string
+
+	// Mirror receives a copy of the route's requests.
+	Mirror *Mirror
+
+	// StaticDir, when set, is served by caddy itself instead of proxying
+	// to an upstream service.
+	StaticDir   *dagger.Directory
+	SPAFallback bool
+
+	// Stubs, when set, are answered by caddy itself instead of proxying
+	// to an upstream service.
+	Stubs []*Stub
+
+	// SiteSnippets are raw Caddyfile snippets added to the site serving
+	// the route.
+	SiteSnippets []string
 }
 
-func New() *Caddy {
+func New(
+	// The caddy image to run.
+	//
+	// +default="caddy:2.8.4"
+	image string,
+
+	// The digest to pin the image to, e.g. sha256:... It only pins the runtime
+	// image: with plugins, the xcaddy builder image is not pinned, and neither
+	// are plugin modules without a version, e.g. module@v1.2.3
+	//
+	// +optional
+	digest string,
+
+	// Caddy plugin modules to build into a custom caddy binary using xcaddy,
+	// e.g. github.com/mholt/caddy-ratelimit
+	//
+	// The binary is built using the builder variant of the image, e.g.
+	// caddy:2.8.4-builder for caddy:2.8.4
+	//
+	// +optional
+	plugins []string,
+) *Caddy {
 	return &Caddy{
+		Image:    image,
+		Digest:   digest,
+		Plugins:  plugins,
 		Services: []*ServiceConfig{},
 	}
 }
 
-func (c *Caddy) WithService(ctx context.Context, upstreamService *dagger.Service, upstreamName string, upstreamPort int32) *Caddy {
+func (c *Caddy) WithService(
+	ctx context.Context,
+	upstreamService *dagger.Service,
+	upstreamName string,
+	upstreamPort int32,
+	// The port caddy listens on for this service.
+	//
+	// Defaults to the upstream port.
+	//
+	// +optional
+	listenPort int32,
+	// The upstream path to actively health check, e.g. /healthz
+	//
+	// +optional
+	healthPath string,
+	// How often to run the active health check.
+	//
+	// +default="10s"
+	healthInterval string,
+	// The status code expected from the health check, e.g. 200 or 2xx
+	//
+	// +default="2xx"
+	healthStatus string,
+	// Delay every request by this duration, e.g. 500ms, to simulate a slow
+	// upstream.
+	//
+	// +optional
+	faultLatency string,
+	// The percentage of requests answered with 503 Service Unavailable, to
+	// simulate a flaky upstream.
+	//
+	// +optional
+	faultErrorPercent int,
+	// The percentage of requests whose connection is closed without a response.
+	//
+	// +optional
+	faultDropPercent int,
+) *Caddy {
+	if listenPort == 0 {
+		listenPort = upstreamPort
+	}
+
+	svc := &ServiceConfig{
+		UpstreamName: upstreamName,
+		UpstreamPort: upstreamPort,
+		UpstreamSvc:  upstreamService,
+		ListenPort:   listenPort,
+		Faults:       newFaults(faultLatency, faultErrorPercent, 503, faultDropPercent),
+	}
+
+	if healthPath != "" {
+		svc.HealthPath = healthPath
+		svc.HealthInterval = healthInterval
+		svc.HealthStatus = healthStatus
+	}
+
+	c.Services = append(c.Services, svc)
+
+	return c
+}
+
+// WithHostRoute routes requests for the given hostname (e.g. backend.localhost)
+// to the upstream service. All host routes share a single listener on port 80,
+// or 443 when TLS is enabled.
+func (c *Caddy) WithHostRoute(
+	ctx context.Context,
+	upstreamService *dagger.Service,
+	// The host name to match, e.g. backend.localhost
+	hostname string,
+	upstreamPort int32,
+	// The name used to bind the upstream service in the caddy container.
+	//
+	// Defaults to the hostname with dots replaced by dashes.
+	//
+	// +optional
+	upstreamName string,
+) *Caddy {
+	if upstreamName == "" {
+		upstreamName = strings.ReplaceAll(hostname, ".", "-")
+	}
+
 	c.Services = append(c.Services, &ServiceConfig{
 		UpstreamName: upstreamName,
 		UpstreamPort: upstreamPort,
 		UpstreamSvc:  upstreamService,
+		Hostname:     hostname,
 	})
 
 	return c
 }
 
-func (c *Caddy) GetCaddyFile(ctx context.Context) string {
-	caddyFile := ""
-	for _, svc := range c.Services {
-		caddyFile += fmt.Sprintf(`
-:%d {
-		reverse_proxy %s:%d
+// WithPathRoute routes requests matching the given path to the upstream service.
+// All path routes share a single listener on port 80 (443 when TLS is enabled),
+// and are matched from the most to the least specific path.
+func (c *Caddy) WithPathRoute(
+	ctx context.Context,
+	upstreamService *dagger.Service,
+	upstreamName string,
+	upstreamPort int32,
+	// The caddy path matcher, e.g. /api/* or /metrics. Use / to route
+	// everything not matched by other paths.
+	path string,
+	// Strip the matched path prefix before proxying, e.g. /api/users
+	// is proxied as /users for the path /api/*
+	//
+	// +optional
+	stripPrefix bool,
+	// Only route requests for this host name.
+	//
+	// +optional
+	hostname string,
+) *Caddy {
+	c.Services = append(c.Services, &ServiceConfig{
+		UpstreamName: upstreamName,
+		UpstreamPort: upstreamPort,
+		UpstreamSvc:  upstreamService,
+		Hostname:     hostname,
+		Path:         path,
+		StripPrefix:  stripPrefix,
+	})
+
+	return c
 }
 
-`, svc.UpstreamPort, svc.UpstreamName, svc.UpstreamPort)
+// GetCaddyFile returns the Caddyfile caddy is run with.
+func (c *Caddy) GetCaddyFile(ctx context.Context) (string, error) {
+	if c.CustomCaddyfile != nil {
+		return c.CustomCaddyfile.Contents(ctx)
 	}
 
-	return caddyFile
+	return c.caddyfile().String(), nil
 }
 
-func (c *Caddy) Container(ctx context.Context) *dagger.Container {
-	ctr := dag.Container().From("caddy:2.8.4").
-		WithNewFile("/opt/caddy/caddyfile", c.GetCaddyFile(ctx))
+func (c *Caddy) Container(ctx context.Context) (*dagger.Container, error) {
+	if err := c.Validate(ctx); err != nil {
+		return nil, err
+	}
+
+	caddyFile, err := c.GetCaddyFile(ctx)
+	if err != nil {
+		return nil, err
+	}
 
+	ctr := c.base().
+		WithNewFile(caddyfilePath, caddyFile)
+
+	if c.InternalTLS {
+		ctr = ctr.WithMountedDirectory(localCAPath, c.LocalCA)
+	}
+
+	for _, svc := range c.Services {
+		if svc.StaticDir != nil {
+			ctr = ctr.WithMountedDirectory(svc.staticRoot(), svc.StaticDir)
+		}
+	}
+
+	for i, cert := range c.Certificates {
+		certFile, keyFile := certificatePaths(i)
+		ctr = ctr.WithMountedFile(certFile, cert.Cert).
+			WithMountedSecret(keyFile, cert.Key)
+	}
+
+	run := []string{"caddy", "run", "--config", caddyfilePath, "--adapter", "caddyfile"}
+	if c.AccessLog {
+		// the log volume outlives the container, so start every run with an empty log.
+		ctr = ctr.WithMountedCache(accessLogDir, dag.CacheVolume(c.AccessLogVolume))
+		run = []string{"sh", "-c", fmt.Sprintf("rm -f %s && exec %s", accessLogPath, strings.Join(run, " "))}
+	}
+
+	// fail here with caddy's error, rather than inside the running service.
+	// Validating doesn't resolve upstreams, so it runs before they are bound
+	// and none of them has to start.
+	ctr, err = ctr.WithExec([]string{"caddy", "validate", "--config", caddyfilePath, "--adapter", "caddyfile"}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caddy configuration: %w", err)
+	}
+
+	exposed := map[int32]bool{}
 	for _, svc := range c.Services {
+		for _, u := range svc.bindings() {
+			ctr = ctr.WithServiceBinding(u.name, u.svc)
+		}
+
+		for _, port := range append([]int32{c.listenPort(svc)}, c.redirectPorts(svc)...) {
+			if exposed[port] {
+				continue
+			}
+
+			ctr = ctr.WithExposedPort(int(port))
+			exposed[port] = true
+		}
+	}
+
+	if c.Metrics {
+		ctr = ctr.WithExposedPort(int(c.MetricsPort))
+	}
+
+	for _, svc := range c.L4Services {
 		ctr = ctr.WithServiceBinding(svc.UpstreamName, svc.UpstreamSvc).
-			WithExposedPort(int(svc.UpstreamPort))
+			WithExposedPort(int(svc.ListenPort), dagger.ContainerWithExposedPortOpts{
+				Protocol: svc.networkProtocol(),
+			})
 	}
 
-	return ctr.WithExec([]string{"caddy", "run", "--config", "/opt/caddy/caddyfile"})
+	return ctr.WithExec(run), nil
 }
 
-func (c *Caddy) Serve(ctx context.Context) *dagger.Service {
-	return c.Container(ctx).AsService()
+func (c *Caddy) Serve(ctx context.Context) (*dagger.Service, error) {
+	ctr, err := c.Container(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctr.AsService(), nil
 }
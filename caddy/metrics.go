@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// WithMetrics exposes caddy's prometheus metrics, including request latency
+// and status histograms and the health of upstreams, on a dedicated port.
+func (c *Caddy) WithMetrics(
+	ctx context.Context,
+	// The port metrics are served on, at /metrics
+	//
+	// +default=9180
+	port int32,
+) *Caddy {
+	c.Metrics = true
+	c.MetricsPort = port
+
+	return c
+}
+
+// MetricsTarget returns the prometheus scrape target of caddy's metrics, e.g.
+// caddy:9180 to use in static_configs.
+func (c *Caddy) MetricsTarget(
+	ctx context.Context,
+	// The name the caddy service is bound as in the prometheus container.
+	//
+	// +default="caddy"
+	alias string,
+) (string, error) {
+	if !c.Metrics {
+		return "", fmt.Errorf("metrics are not enabled, use with-metrics first")
+	}
+
+	return net.JoinHostPort(alias, strconv.Itoa(int(c.MetricsPort))), nil
+}
+
+// metricsSite returns the site serving caddy's metrics.
+func metricsSite(port int32) *site {
+	return &site{
+		Addresses:  []string{fmt.Sprintf(":%d", port)},
+		Directives: []*directive{newDirective("metrics")},
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"dagger/caddy/internal/dagger"
+)
+
+const (
+	// mirrorPortBase is the first loopback port of the sites proxying the
+	// mirrored requests to the shadow services.
+	mirrorPortBase = 19500
+
+	// mirrorHeader correlates the requests of a mirrored route with their
+	// copies in the access log.
+	mirrorHeader = "X-Caddy-Mirror-Id"
+)
+
+// Mirror is a shadow service receiving a copy of a route's requests.
+type Mirror struct {
+	UpstreamName string
+	UpstreamPort int32
+	UpstreamSvc  *dagger.Service
+}
+
+// WithMirror sends a copy of every request to the named upstream to a shadow
+// service, e.g. a candidate build of the upstream, and discards its responses.
+// With access logs enabled, MirrorDiffs lists the requests the shadow service
+// answered with a different status. Caddy is built with the caddy-l4 plugin
+// to copy the requests.
+//
+// The requests are copied by a layer4 hop in front of the upstream, so
+// mirroring can't be combined with replicas, load balancing or health checks.
+func (c *Caddy) WithMirror(
+	ctx context.Context,
+	// The upstream name of the routes to mirror.
+	upstreamName string,
+	shadowService *dagger.Service,
+	// The name used to bind the shadow service in the caddy container.
+	shadowName string,
+	shadowPort int32,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Mirror = &Mirror{
+			UpstreamName: shadowName,
+			UpstreamPort: shadowPort,
+			UpstreamSvc:  shadowService,
+		}
+	})
+}
+
+// MirrorDiffs returns the mirrored requests of the last caddy run the shadow
+// service answered with a different status than the upstream, one per line.
+func (c *Caddy) MirrorDiffs(ctx context.Context) (string, error) {
+	logs, err := c.AccessLogs(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	contents, err := logs.Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return mirrorDiffs(contents)
+}
+
+// mirrorDiffs returns the status differences between the mirrored requests
+// in the access log and their copies.
+func mirrorDiffs(log string) (string, error) {
+	type entry struct {
+		Request struct {
+			Method  string              `json:"method"`
+			URI     string              `json:"uri"`
+			Headers map[string][]string `json:"headers"`
+		} `json:"request"`
+		Status      int                 `json:"status"`
+		RespHeaders map[string][]string `json:"resp_headers"`
+	}
+
+	var requests []*entry
+	shadows := map[string]*entry{}
+	for _, line := range strings.Split(log, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		e := &entry{}
+		if err := json.Unmarshal([]byte(line), e); err != nil {
+			return "", fmt.Errorf("parsing access log: %w", err)
+		}
+
+		// the upstream's response carries the id, its copy's request does.
+		if ids := e.RespHeaders[mirrorHeader]; len(ids) > 0 {
+			requests = append(requests, e)
+		} else if ids := e.Request.Headers[mirrorHeader]; len(ids) > 0 {
+			shadows[ids[0]] = e
+		}
+	}
+
+	var diffs []string
+	for _, e := range requests {
+		request := e.Request.Method + " " + e.Request.URI
+		upstream := strings.Join(e.RespHeaders[upstreamHeader], ", ")
+
+		shadow, ok := shadows[e.RespHeaders[mirrorHeader][0]]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: %s %d, shadow request not logged", request, upstream, e.Status))
+			continue
+		}
+
+		if shadow.Status != e.Status {
+			diffs = append(diffs, fmt.Sprintf("%s: %s %d, %s %d", request, upstream, e.Status,
+				strings.Join(shadow.RespHeaders[upstreamHeader], ", "), shadow.Status))
+		}
+	}
+
+	return strings.Join(diffs, "\n"), nil
+}
+
+// mirrorPort returns the loopback port of the site proxying the route's
+// mirrored requests, or 0 if the route is not mirrored.
+func (c *Caddy) mirrorPort(svc *ServiceConfig) int32 {
+	port := int32(mirrorPortBase)
+	for _, other := range c.Services {
+		if other.Mirror == nil {
+			continue
+		}
+
+		if other == svc {
+			return port
+		}
+		port++
+	}
+
+	return 0
+}
+
+// mirrorSites returns the sites proxying the mirrored requests copied by the
+// routes' layer4 hops to the shadow services.
+func (c *Caddy) mirrorSites() []*site {
+	var sites []*site
+	for _, svc := range c.Services {
+		port := c.mirrorPort(svc)
+		if port == 0 {
+			continue
+		}
+
+		proxy := newDirective("reverse_proxy", net.JoinHostPort(svc.Mirror.UpstreamName, strconv.Itoa(int(svc.Mirror.UpstreamPort))))
+		if transport := c.transport(svc); transport != nil {
+			proxy.withBlock(transport)
+		}
+
+		s := &site{
+			Addresses:  []string{fmt.Sprintf(":%d", port)},
+			Directives: []*directive{newDirective("bind", "127.0.0.1")},
+		}
+
+		if c.AccessLog {
+			s.Directives = append(s.Directives, accessLog())
+			proxy.withBlock(newDirective("header_down", upstreamHeader, "{http.reverse_proxy.upstream.hostport}"))
+		}
+
+		s.Directives = append(s.Directives, proxy)
+		sites = append(sites, s)
+	}
+
+	return sites
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestMirrorDiffs(t *testing.T) {
+	log := `{"request":{"method":"GET","uri":"/api/users","headers":{}},"status":200,"resp_headers":{"X-Caddy-Mirror-Id":["1"],"X-Caddy-Upstream":["backend:8080"]}}
+{"request":{"method":"GET","uri":"/api/users","headers":{"X-Caddy-Mirror-Id":["1"]}},"status":500,"resp_headers":{"X-Caddy-Upstream":["backend-next:8080"]}}
+{"request":{"method":"GET","uri":"/healthz","headers":{}},"status":200,"resp_headers":{"X-Caddy-Mirror-Id":["2"],"X-Caddy-Upstream":["backend:8080"]}}
+{"request":{"method":"GET","uri":"/healthz","headers":{"X-Caddy-Mirror-Id":["2"]}},"status":200,"resp_headers":{"X-Caddy-Upstream":["backend-next:8080"]}}
+{"request":{"method":"POST","uri":"/api/users","headers":{}},"status":201,"resp_headers":{"X-Caddy-Mirror-Id":["3"],"X-Caddy-Upstream":["backend:8080"]}}
+`
+
+	got, err := mirrorDiffs(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "GET /api/users: backend:8080 200, backend-next:8080 500\n" +
+		"POST /api/users: backend:8080 201, shadow request not logged"
+	if got != want {
+		t.Errorf("mirrorDiffs() = %q, want %q", got, want)
+	}
+}
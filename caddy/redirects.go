@@ -0,0 +1,136 @@
+package main
+
+import "context"
+
+// Rewrite rewrites the URI of the requests matching Path to To before they
+// are handled.
+type Rewrite struct {
+	Path string
+	To   string
+}
+
+// WithHTTPSRedirect redirects plain http requests on port 80 for the host names
+// of the named upstream's routes to https, like a production edge would.
+// The routes must be served over TLS.
+func (c *Caddy) WithHTTPSRedirect(
+	ctx context.Context,
+	// The upstream name of the routes to redirect to.
+	upstreamName string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.HTTPSRedirect = true
+	})
+}
+
+// WithCanonicalHost permanently redirects requests for the given aliases, e.g.
+// www.example.localhost, to the host name of the named upstream's host routes.
+func (c *Caddy) WithCanonicalHost(
+	ctx context.Context,
+	// The upstream name of the host routes to redirect to.
+	upstreamName string,
+	// The host names redirected to the canonical host name.
+	aliases []string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.HostAliases = append(svc.HostAliases, aliases...)
+	})
+}
+
+// WithRewrite rewrites the URI of requests to the named upstream before they
+// are proxied, e.g. to add or remove trailing slashes.
+func (c *Caddy) WithRewrite(
+	ctx context.Context,
+	// The upstream name of the routes to rewrite the requests of.
+	upstreamName string,
+	// The caddy path matcher of the requests to rewrite, e.g. /docs
+	path string,
+	// The URI to rewrite to, which can use placeholders, e.g. {path}/
+	to string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Rewrites = append(svc.Rewrites, &Rewrite{Path: path, To: to})
+	})
+}
+
+// rewriteDirectives returns the directives rewriting the route's requests, if any.
+func (svc *ServiceConfig) rewriteDirectives() []*directive {
+	var directives []*directive
+	for _, rewrite := range svc.Rewrites {
+		directives = append(directives, newDirective("rewrite", rewrite.Path, rewrite.To))
+	}
+
+	return directives
+}
+
+// aliasRoute returns a route for an alias of the route's host name, served on
+// the same port.
+func (svc *ServiceConfig) aliasRoute(alias string) *ServiceConfig {
+	return &ServiceConfig{
+		UpstreamName: svc.UpstreamName,
+		Hostname:     alias,
+		ListenPort:   svc.ListenPort,
+	}
+}
+
+// redirectPorts returns the ports caddy listens on to redirect requests to
+// the route.
+func (c *Caddy) redirectPorts(svc *ServiceConfig) []int32 {
+	var ports []int32
+	if svc.HTTPSRedirect {
+		ports = append(ports, httpPort)
+	}
+
+	for _, alias := range svc.HostAliases {
+		ports = append(ports, c.listenPort(svc.aliasRoute(alias)))
+	}
+
+	return ports
+}
+
+// redirectSites returns the sites redirecting requests to https and to
+// canonical host names.
+func (c *Caddy) redirectSites() []*site {
+	var sites []*site
+	seen := map[string]bool{}
+	for _, svc := range c.Services {
+		if svc.HTTPSRedirect {
+			target := siteAddress("https", "{host}", c.listenPort(svc), httpsPort) + "{uri}"
+			for _, hostname := range c.siteHostnames(svc) {
+				address := "http://" + hostname
+				if seen[address] {
+					continue
+				}
+				seen[address] = true
+
+				sites = append(sites, &site{
+					Addresses:  []string{address},
+					Directives: []*directive{newDirective("redir", target, "308")},
+				})
+			}
+		}
+
+		if len(svc.HostAliases) == 0 {
+			continue
+		}
+
+		target := c.siteAddresses(svc)[0] + "{uri}"
+		for _, alias := range svc.HostAliases {
+			route := svc.aliasRoute(alias)
+			addresses := c.siteAddresses(route)
+			if seen[addresses[0]] {
+				continue
+			}
+			seen[addresses[0]] = true
+
+			s := &site{Addresses: addresses}
+			if tls := c.siteTLS(route); tls != nil {
+				s.Directives = append(s.Directives, tls)
+			}
+
+			s.Directives = append(s.Directives, newDirective("redir", target, "301"))
+			sites = append(sites, s)
+		}
+	}
+
+	return sites
+}
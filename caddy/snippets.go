@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// WithCaddyfile runs caddy with the given Caddyfile instead of generating one.
+// Services are still bound and their ports exposed, so the Caddyfile can proxy
+// to them by their upstream names. Snippets are not added to a custom Caddyfile.
+func (c *Caddy) WithCaddyfile(ctx context.Context, file *dagger.File) *Caddy {
+	c.CustomCaddyfile = file
+
+	return c
+}
+
+// WithGlobalSnippet adds raw Caddyfile content to the global options block,
+// for options the module does not model.
+func (c *Caddy) WithGlobalSnippet(
+	ctx context.Context,
+	// The Caddyfile content, e.g. "debug"
+	snippet string,
+) *Caddy {
+	c.GlobalSnippets = append(c.GlobalSnippets, snippet)
+
+	return c
+}
+
+// WithSiteSnippet adds raw Caddyfile content to the sites serving the routes
+// to the named upstream, for directives the module does not model.
+func (c *Caddy) WithSiteSnippet(
+	ctx context.Context,
+	// The upstream name of the routes whose site gets the snippet.
+	upstreamName string,
+	// The Caddyfile content, e.g. "request_body { max_size 10MB }"
+	snippet string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.SiteSnippets = append(svc.SiteSnippets, snippet)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// staticSitesPath is where the directories of static sites are mounted.
+const staticSitesPath = "/srv"
+
+// WithStaticSite serves the files of a directory, e.g. a generated frontend,
+// directly from caddy. Proxy settings like health checks, replicas, upstream
+// protocols and streaming options can't be used on static sites.
+func (c *Caddy) WithStaticSite(
+	ctx context.Context,
+	dir *dagger.Directory,
+	// The port caddy serves the files on.
+	listenPort int32,
+	// Serve /index.html for paths that do not match a file, as needed by
+	// single page applications doing client side routing.
+	//
+	// +optional
+	spaFallback bool,
+	// The name of the site, used to refer to it in other functions.
+	//
+	// Defaults to static-<listen port>.
+	//
+	// +optional
+	name string,
+) *Caddy {
+	if name == "" {
+		name = fmt.Sprintf("static-%d", listenPort)
+	}
+
+	c.Services = append(c.Services, &ServiceConfig{
+		UpstreamName: name,
+		ListenPort:   listenPort,
+		StaticDir:    dir,
+		SPAFallback:  spaFallback,
+	})
+
+	return c
+}
+
+// staticRoot returns where the directory of a static site is mounted.
+func (svc *ServiceConfig) staticRoot() string {
+	return path.Join(staticSitesPath, svc.UpstreamName)
+}
+
+func (svc *ServiceConfig) fileServer() []*directive {
+	directives := []*directive{newDirective("root", "*", svc.staticRoot())}
+	if svc.SPAFallback {
+		directives = append(directives, newDirective("try_files", "{path}", "/index.html"))
+	}
+
+	return append(directives, newDirective("file_server"))
+}
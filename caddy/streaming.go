@@ -0,0 +1,36 @@
+package main
+
+import "context"
+
+// WithStreaming tunes the routes to the named upstream for long lived streams,
+// like server-sent events or the websockets of hot reloading dev servers.
+//
+// Caddy proxies websocket upgrades out of the box. This flushes responses as
+// they are written instead of buffering them, and optionally bounds how long
+// the proxy waits on the upstream.
+func (c *Caddy) WithStreaming(
+	ctx context.Context,
+	// The upstream name of the routes to configure.
+	upstreamName string,
+	// How often to flush responses to the client, -1 flushes immediately
+	// after every write instead of buffering.
+	//
+	// +default="-1"
+	flushInterval string,
+	// How long to wait for the upstream to send data, e.g. 1h. By default
+	// there is no limit.
+	//
+	// +optional
+	readTimeout string,
+	// How long to wait for the upstream to accept data, e.g. 1h. By default
+	// there is no limit.
+	//
+	// +optional
+	writeTimeout string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.FlushInterval = flushInterval
+		svc.ReadTimeout = readTimeout
+		svc.WriteTimeout = writeTimeout
+	})
+}
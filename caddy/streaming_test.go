@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestWebsocketUpgrade proxies a websocket handshake to an echo server
+// through caddy. It needs a dagger engine, e.g. dagger run go test ./...
+func TestWebsocketUpgrade(t *testing.T) {
+	if os.Getenv("DAGGER_SESSION_PORT") == "" {
+		t.Skip("not running in a dagger session")
+	}
+
+	ctx := context.Background()
+
+	echo := dag.Container().
+		From("jmalloc/echo-server").
+		WithExposedPort(8080).
+		AsService()
+
+	c, err := New("caddy:2.8.4", "", nil).
+		WithService(ctx, echo, "echo", 8080, 0, "", "", "", "", 0, 0).
+		WithStreaming(ctx, "echo", "-1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := c.Serve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the upgraded connection stays open, so stop curl after the handshake.
+	out, err := dag.Container().
+		From("curlimages/curl:8.10.1").
+		WithServiceBinding("caddy", proxy).
+		WithExec([]string{"sh", "-c", `curl -si --http1.1 --max-time 5 \
+			-H 'Connection: Upgrade' -H 'Upgrade: websocket' \
+			-H 'Sec-WebSocket-Version: 13' -H 'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==' \
+			http://caddy:8080/.ws | head -n 1`}).
+		Stdout(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "HTTP/1.1 101 Switching Protocols\r\n"; out != want {
+		t.Errorf("handshake response = %q, want %q", out, want)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// Stub is a canned response caddy answers matching requests with.
+type Stub struct {
+	// Method is the request method to match, or empty for any method.
+	Method string
+	Path   string
+	Status int
+	Body   string
+	// Headers are the response headers, as Name: value
+	Headers []string
+}
+
+// WithStubRoute answers requests for the given path with a canned response,
+// e.g. to stand in for a third-party API in a pipeline without network access.
+//
+// Stubs on the same host name and listen port are served by the same route,
+// named stub-<host name with dots replaced by dashes>, stub-<listen port>
+// or stubs, which other functions can refer to. Proxy settings like health
+// checks, replicas, upstream protocols and streaming options can't be used on
+// stub routes.
+func (c *Caddy) WithStubRoute(
+	ctx context.Context,
+	// The caddy path matcher, e.g. /oauth/token or /v1/charges/*
+	path string,
+	// The response status.
+	//
+	// +default=200
+	status int,
+	// The response body.
+	//
+	// +optional
+	body string,
+	// The response headers, e.g. Content-Type: application/json
+	//
+	// +optional
+	headers []string,
+	// Only answer requests with this method, e.g. POST
+	//
+	// +optional
+	method string,
+	// Only answer requests for this host name, e.g. api.stripe.com
+	//
+	// +optional
+	hostname string,
+	// The port caddy serves the stub on.
+	//
+	// Defaults to 80, or 443 when TLS is enabled.
+	//
+	// +optional
+	listenPort int32,
+) *Caddy {
+	svc := c.stubRoute(hostname, listenPort)
+	svc.Stubs = append(svc.Stubs, &Stub{
+		Method:  strings.ToUpper(method),
+		Path:    path,
+		Status:  status,
+		Body:    body,
+		Headers: headers,
+	})
+
+	return c
+}
+
+// WithStubDirectory loads stubs from a directory of fixture files laid out as
+// <method>/<path>, e.g. POST/oauth/token.json answers POST /oauth/token with
+// the file's contents. The file extension is stripped from the path and sets
+// the Content-Type of the response, which has status 200.
+func (c *Caddy) WithStubDirectory(
+	ctx context.Context,
+	dir *dagger.Directory,
+	// Only answer requests for this host name, e.g. api.stripe.com
+	//
+	// +optional
+	hostname string,
+	// The port caddy serves the stubs on.
+	//
+	// Defaults to 80, or 443 when TLS is enabled.
+	//
+	// +optional
+	listenPort int32,
+) (*Caddy, error) {
+	entries, err := dir.Glob(ctx, "**/*")
+	if err != nil {
+		return nil, fmt.Errorf("listing stub fixtures: %w", err)
+	}
+
+	svc := c.stubRoute(hostname, listenPort)
+	for _, file := range fixtureFiles(entries) {
+		method, filePath, ok := strings.Cut(file, "/")
+		if !ok {
+			return nil, fmt.Errorf("stub fixture %q is not in a method directory", file)
+		}
+
+		body, err := dir.File(file).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading stub fixture %q: %w", file, err)
+		}
+
+		stub := &Stub{
+			Method: strings.ToUpper(method),
+			Path:   "/" + strings.TrimSuffix(filePath, path.Ext(filePath)),
+			Status: 200,
+			Body:   body,
+		}
+
+		if contentType := mime.TypeByExtension(path.Ext(filePath)); contentType != "" {
+			stub.Headers = []string{"Content-Type: " + contentType}
+		}
+
+		svc.Stubs = append(svc.Stubs, stub)
+	}
+
+	return c, nil
+}
+
+// fixtureFiles returns the files among the entries of a directory glob,
+// leaving out the directories containing them.
+func fixtureFiles(entries []string) []string {
+	var files []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry, "/") {
+			continue
+		}
+
+		isDir := slices.ContainsFunc(entries, func(other string) bool {
+			return strings.HasPrefix(other, entry+"/")
+		})
+		if !isDir {
+			files = append(files, entry)
+		}
+	}
+
+	return files
+}
+
+// stubRoute returns the route serving the stubs of a host name and listen
+// port, adding it if needed.
+func (c *Caddy) stubRoute(hostname string, listenPort int32) *ServiceConfig {
+	for _, svc := range c.Services {
+		if len(svc.Stubs) > 0 && svc.Hostname == hostname && svc.ListenPort == listenPort {
+			return svc
+		}
+	}
+
+	name := "stubs"
+	switch {
+	case hostname != "":
+		name = "stub-" + strings.ReplaceAll(hostname, ".", "-")
+	case listenPort != 0:
+		name = fmt.Sprintf("stub-%d", listenPort)
+	}
+
+	svc := &ServiceConfig{
+		UpstreamName: name,
+		Hostname:     hostname,
+		ListenPort:   listenPort,
+	}
+	c.Services = append(c.Services, svc)
+
+	return svc
+}
+
+// proxied reports whether the route proxies to an upstream service, rather
+// than being answered by caddy itself.
+func (svc *ServiceConfig) proxied() bool {
+	return svc.StaticDir == nil && len(svc.Stubs) == 0
+}
+
+// stubResponses returns the directives answering the route's requests with
+// its stubs, and with 404 Not Found when no stub matches.
+func (svc *ServiceConfig) stubResponses() []*directive {
+	var directives []*directive
+	for i, stub := range svc.Stubs {
+		matcher := "@stub_" + strconv.Itoa(i+1)
+		match := newDirective(matcher)
+		if stub.Method != "" {
+			match.withBlock(newDirective("method", stub.Method))
+		}
+		match.withBlock(newDirective("path", stub.Path))
+
+		handle := newDirective("handle", matcher)
+		for _, header := range stub.Headers {
+			name, value, _ := strings.Cut(header, ":")
+			handle.withBlock(newDirective("header", strings.TrimSpace(name), strings.TrimSpace(value)))
+		}
+
+		respond := newDirective("respond", strconv.Itoa(stub.Status))
+		if stub.Body != "" {
+			respond.Args = []string{stub.Body, strconv.Itoa(stub.Status)}
+		}
+
+		directives = append(directives, match, handle.withBlock(respond))
+	}
+
+	return append(directives, newDirective("handle").withBlock(
+		newDirective("respond", "no stub for {method} {uri}", "404"),
+	))
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestFixtureFiles(t *testing.T) {
+	entries := []string{"GET", "GET/users.json", "GET/users", "GET/users/1.json", "POST/", "POST/oauth/", "POST/oauth/token.json"}
+
+	got := fixtureFiles(entries)
+	want := []string{"GET/users.json", "GET/users/1.json", "POST/oauth/token.json"}
+	if !slices.Equal(got, want) {
+		t.Errorf("fixtureFiles() = %q, want %q", got, want)
+	}
+}
+
+func TestStubRouteDoesNotEnableH2C(t *testing.T) {
+	ctx := context.Background()
+
+	c := must(t)(New("caddy:2.8.4", "", nil).
+		WithStubRoute(ctx, "/api/users", 200, `[]`, nil, "", "", 0).
+		WithUpstreamProtocol(ctx, "stubs", "h2c"))
+	if c.usesH2C() {
+		t.Error("usesH2C() = true for a stub route, want false")
+	}
+}
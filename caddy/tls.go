@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"dagger/caddy/internal/dagger"
+)
+
+const (
+	// localCAPath is where the root certificate and key of the internal
+	// issuer are mounted in the caddy container.
+	localCAPath = "/etc/caddy/pki"
+
+	// certificatesPath is where user provided certificates are mounted.
+	certificatesPath = "/etc/caddy/certs"
+)
+
+// Certificate is a user provided TLS certificate and its private key.
+type Certificate struct {
+	// Cert is the PEM encoded certificate (chain).
+	Cert *dagger.File
+	// Key is the PEM encoded private key.
+	Key *dagger.Secret
+	// Hostnames are the host names the certificate is used for, and
+	// may include wildcards like *.example.com
+	Hostnames []string
+}
+
+// WithInternalTLS terminates https on all sites using caddy's internal issuer.
+//
+// The issuer's root certificate is generated once and can be retrieved with
+// RootCertificate, so that clients can be configured to trust it.
+func (c *Caddy) WithInternalTLS(
+	ctx context.Context,
+	// The host names certificates are issued for on sites that are not
+	// routed by host name, e.g. the alias the caddy service is bound as.
+	//
+	// +default=["localhost"]
+	hostnames []string,
+) *Caddy {
+	c.InternalTLS = true
+	c.TLSHostnames = hostnames
+	if c.LocalCA == nil {
+		c.LocalCA = localCA()
+	}
+
+	return c
+}
+
+// RootCertificate returns the root CA certificate of caddy's internal issuer.
+func (c *Caddy) RootCertificate(ctx context.Context) (*dagger.File, error) {
+	if !c.InternalTLS {
+		return nil, fmt.Errorf("internal tls is not enabled, use with-internal-tls first")
+	}
+
+	return c.LocalCA.File("root.crt"), nil
+}
+
+// WithTLSCertificate serves https for the given host names using the provided
+// certificate, instead of one issued by caddy. The key is mounted as a secret,
+// and never written to the container's layers.
+//
+// The certificate is used by host routes matching its host names, and with
+// internal TLS, by the other sites when it covers one of the host names passed
+// to WithInternalTLS.
+func (c *Caddy) WithTLSCertificate(
+	ctx context.Context,
+	// The PEM encoded certificate, including intermediates.
+	cert *dagger.File,
+	// The PEM encoded private key.
+	key *dagger.Secret,
+	// The host names to use the certificate for, e.g. app.example.com or *.example.com
+	hostnames []string,
+) *Caddy {
+	c.Certificates = append(c.Certificates, &Certificate{
+		Cert:      cert,
+		Key:       key,
+		Hostnames: hostnames,
+	})
+
+	return c
+}
+
+// servesTLS reports whether the service's site is served over https.
+func (c *Caddy) servesTLS(svc *ServiceConfig) bool {
+	if c.InternalTLS {
+		return true
+	}
+
+	return svc.Hostname != "" && c.certificateFor(svc.Hostname) >= 0
+}
+
+// siteHostnames returns the host names of the https site serving the service.
+func (c *Caddy) siteHostnames(svc *ServiceConfig) []string {
+	if svc.Hostname != "" {
+		return []string{svc.Hostname}
+	}
+
+	return c.TLSHostnames
+}
+
+// siteTLS returns the tls directive for the site serving the service, if any.
+// A provided certificate covering one of the site's host names takes precedence
+// over the internal issuer.
+func (c *Caddy) siteTLS(svc *ServiceConfig) *directive {
+	if !c.servesTLS(svc) {
+		return nil
+	}
+
+	if i := c.siteCertificate(svc); i >= 0 {
+		certFile, keyFile := certificatePaths(i)
+		return newDirective("tls", certFile, keyFile)
+	}
+
+	return newDirective("tls", "internal")
+}
+
+// siteCertificate returns the index of the provided certificate used by the
+// site serving the service, or -1 if it uses none.
+func (c *Caddy) siteCertificate(svc *ServiceConfig) int {
+	if !c.servesTLS(svc) {
+		return -1
+	}
+
+	for _, hostname := range c.siteHostnames(svc) {
+		if i := c.certificateFor(hostname); i >= 0 {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// certificateFor returns the index of the first certificate covering the
+// host name, or -1 if there is none.
+func (c *Caddy) certificateFor(hostname string) int {
+	for i, cert := range c.Certificates {
+		for _, pattern := range cert.Hostnames {
+			if matchesHostname(pattern, hostname) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// matchesHostname matches a host name against a certificate name, where a
+// leading wildcard label matches exactly one label.
+func matchesHostname(pattern, hostname string) bool {
+	if strings.EqualFold(pattern, hostname) {
+		return true
+	}
+
+	suffix, ok := strings.CutPrefix(pattern, "*.")
+	if !ok {
+		return false
+	}
+
+	_, rest, ok := strings.Cut(hostname, ".")
+	return ok && strings.EqualFold(rest, suffix)
+}
+
+// certificatePaths returns where the i-th provided certificate and key are mounted.
+func certificatePaths(i int) (string, string) {
+	dir := path.Join(certificatesPath, strconv.Itoa(i))
+	return path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+}
+
+// localCA generates the root certificate and key for the internal issuer.
+// caddy creates the intermediate certificate from it when it starts.
+func localCA() *dagger.Directory {
+	return dag.Container().
+		From("alpine:3.20").
+		WithExec([]string{"apk", "add", "--no-cache", "openssl"}).
+		WithWorkdir("/ca").
+		WithExec([]string{
+			"openssl", "req", "-x509", "-nodes",
+			"-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:prime256v1",
+			"-days", "3650",
+			"-subj", "/CN=Caddy Local Authority - Dagger Root",
+			"-addext", "keyUsage=critical,keyCertSign,cRLSign",
+			"-keyout", "root.key",
+			"-out", "root.crt",
+		}).
+		Directory("/ca")
+}
+
+// internalTLSOptions returns the global options making the internal issuer
+// use the mounted root certificate, instead of generating one at runtime.
+func internalTLSOptions() []*directive {
+	return []*directive{
+		newDirective("skip_install_trust"),
+		newDirective("pki").withBlock(
+			newDirective("ca", "local").withBlock(
+				newDirective("root").withBlock(
+					newDirective("cert", path.Join(localCAPath, "root.crt")),
+					newDirective("key", path.Join(localCAPath, "root.key")),
+				),
+			),
+		),
+	}
+}
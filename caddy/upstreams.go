@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"dagger/caddy/internal/dagger"
+)
+
+// upstreamProtocols are the protocols caddy can talk to upstreams with.
+var upstreamProtocols = []string{"http", "h2c", "https-insecure"}
+
+// lbPolicies are the caddy load balancing policies that can be selected
+// without further arguments.
+var lbPolicies = []string{
+	"random",
+	"first",
+	"round_robin",
+	"least_conn",
+	"ip_hash",
+	"client_ip_hash",
+	"uri_hash",
+	"cookie",
+}
+
+// upstream is a service bound in the caddy container under a host name.
+type upstream struct {
+	name string
+	svc  *dagger.Service
+}
+
+// WithReplicas load balances the routes to the named upstream across the
+// upstream service and the given replicas of it.
+func (c *Caddy) WithReplicas(
+	ctx context.Context,
+	// The upstream name of the routes to load balance.
+	upstreamName string,
+	// Additional instances of the upstream service. They must listen on the
+	// same port as the upstream service.
+	replicas []*dagger.Service,
+	// The load balancing policy, one of random, first, round_robin, least_conn,
+	// ip_hash, client_ip_hash, uri_hash or cookie (sticky sessions).
+	//
+	// +default="round_robin"
+	lbPolicy string,
+	// How long to remember a failed request to an instance, which enables
+	// passive health checks, e.g. 30s
+	//
+	// +optional
+	failDuration string,
+	// The number of failed requests within failDuration after which an
+	// instance is considered down.
+	//
+	// +optional
+	maxFails int,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.Replicas = replicas
+		svc.LBPolicy = lbPolicy
+		svc.FailDuration = failDuration
+		svc.MaxFails = maxFails
+	})
+}
+
+// WithUpstreamProtocol sets how caddy talks to the named upstream, e.g. h2c
+// for gRPC services that only speak cleartext HTTP/2.
+func (c *Caddy) WithUpstreamProtocol(
+	ctx context.Context,
+	// The upstream name of the routes to configure.
+	upstreamName string,
+	// One of http, h2c (cleartext HTTP/2) or https-insecure (https without
+	// verifying the upstream's certificate).
+	protocol string,
+) (*Caddy, error) {
+	return c.withRoutes(upstreamName, func(svc *ServiceConfig) {
+		svc.UpstreamProtocol = protocol
+	})
+}
+
+// routesTo returns the services proxying to the named upstream.
+func (c *Caddy) routesTo(upstreamName string) ([]*ServiceConfig, error) {
+	var routes []*ServiceConfig
+	for _, svc := range c.Services {
+		if svc.UpstreamName == upstreamName {
+			routes = append(routes, svc)
+		}
+	}
+
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no service with upstream name %q", upstreamName)
+	}
+
+	return routes, nil
+}
+
+// withRoutes configures the services proxying to the named upstream.
+func (c *Caddy) withRoutes(upstreamName string, configure func(svc *ServiceConfig)) (*Caddy, error) {
+	routes, err := c.routesTo(upstreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, svc := range routes {
+		configure(svc)
+	}
+
+	return c, nil
+}
+
+// upstreams returns the services the route proxies to, the replicas being
+// bound as <upstream name>-replica-<n>.
+func (svc *ServiceConfig) upstreams() []upstream {
+	if !svc.proxied() {
+		return nil
+	}
+
+	upstreams := []upstream{{name: svc.UpstreamName, svc: svc.UpstreamSvc}}
+	for i, replica := range svc.Replicas {
+		upstreams = append(upstreams, upstream{
+			name: fmt.Sprintf("%s-replica-%d", svc.UpstreamName, i+1),
+			svc:  replica,
+		})
+	}
+
+	return upstreams
+}
+
+// bindings returns all services the route needs bound in the caddy container.
+func (svc *ServiceConfig) bindings() []upstream {
+	bindings := svc.upstreams()
+	if svc.ForwardAuth != nil {
+		bindings = append(bindings, upstream{name: svc.ForwardAuth.UpstreamName, svc: svc.ForwardAuth.UpstreamSvc})
+	}
+
+	if svc.Mirror != nil {
+		bindings = append(bindings, upstream{name: svc.Mirror.UpstreamName, svc: svc.Mirror.UpstreamSvc})
+	}
+
+	return bindings
+}
+
+func (c *Caddy) reverseProxy(svc *ServiceConfig) *directive {
+	proxy := newDirective("reverse_proxy")
+	if port := c.hopPort(svc); port != 0 {
+		// the connections are proxied to the upstreams by layer4.
+		proxy.Args = append(proxy.Args, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	} else {
+		for _, u := range svc.upstreams() {
+			proxy.Args = append(proxy.Args, net.JoinHostPort(u.name, strconv.Itoa(int(svc.UpstreamPort))))
+		}
+	}
+
+	if svc.FlushInterval != "" {
+		proxy.withBlock(newDirective("flush_interval", svc.FlushInterval))
+	}
+
+	if transport := c.transport(svc); transport != nil {
+		proxy.withBlock(transport)
+	}
+
+	for _, rule := range svc.Headers {
+		if !rule.Response {
+			proxy.withBlock(newDirective("header_up", rule.field()...))
+		}
+	}
+
+	if c.AccessLog {
+		// the access log records response headers, so this tells which
+		// upstream instance served the request. Behind a hop, caddy only
+		// sees the hop, which proxies to the single upstream instance.
+		upstream := "{http.reverse_proxy.upstream.hostport}"
+		if c.hopPort(svc) != 0 {
+			upstream = net.JoinHostPort(svc.UpstreamName, strconv.Itoa(int(svc.UpstreamPort)))
+		}
+		proxy.withBlock(newDirective("header_down", upstreamHeader, upstream))
+	}
+
+	if svc.Mirror != nil {
+		proxy.withBlock(
+			newDirective("header_up", mirrorHeader, "{http.request.uuid}"),
+			newDirective("header_down", mirrorHeader, "{http.request.uuid}"),
+		)
+	}
+
+	if svc.LBPolicy != "" {
+		proxy.withBlock(newDirective("lb_policy", svc.LBPolicy))
+	}
+
+	if svc.FailDuration != "" {
+		proxy.withBlock(newDirective("fail_duration", svc.FailDuration))
+	}
+
+	if svc.MaxFails > 0 {
+		proxy.withBlock(newDirective("max_fails", strconv.Itoa(svc.MaxFails)))
+	}
+
+	if svc.HealthPath != "" {
+		proxy.withBlock(newDirective("health_uri", svc.HealthPath))
+		if svc.HealthInterval != "" {
+			proxy.withBlock(newDirective("health_interval", svc.HealthInterval))
+		}
+
+		if svc.HealthStatus != "" {
+			proxy.withBlock(newDirective("health_status", svc.HealthStatus))
+		}
+	}
+
+	return proxy
+}
+
+// transport returns the transport of the reverse proxy, or nil if the
+// defaults are fine.
+func (c *Caddy) transport(svc *ServiceConfig) *directive {
+	transport := newDirective("transport", "http")
+	switch svc.UpstreamProtocol {
+	case "h2c":
+		transport.withBlock(newDirective("versions", "h2c"))
+	case "https-insecure":
+		transport.withBlock(
+			newDirective("tls"),
+			newDirective("tls_insecure_skip_verify"),
+		)
+	}
+
+	if svc.ReadTimeout != "" {
+		transport.withBlock(newDirective("read_timeout", svc.ReadTimeout))
+	}
+
+	if svc.WriteTimeout != "" {
+		transport.withBlock(newDirective("write_timeout", svc.WriteTimeout))
+	}
+
+	if c.hopPort(svc) != 0 {
+		// layer4 handles connections rather than requests, so don't reuse them.
+		transport.withBlock(newDirective("keepalive", "off"))
+	}
+
+	if len(transport.Block) == 0 {
+		return nil
+	}
+
+	return transport
+}
+
+// usesH2C reports whether any route proxies to a cleartext HTTP/2 upstream.
+func (c *Caddy) usesH2C() bool {
+	for _, svc := range c.Services {
+		if svc.proxied() && svc.UpstreamProtocol == "h2c" {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger/caddy/internal/dagger"
+)
+
+var (
+	// dnsLabel matches a single RFC 1123 host name label.
+	dnsLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	// imageDigest matches an image digest.
+	imageDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+	// byteSize matches a size like 512KB or 10MiB
+	byteSize = regexp.MustCompile(`^(?i)[0-9]+(\.[0-9]+)?\s*([kmgt]i?)?b?$`)
+
+	// healthStatus matches a status code, or a status class like 2xx.
+	healthStatus = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+)
+
+// Validate checks the configured services and returns an error listing
+// all problems found, if any.
+func (c *Caddy) Validate(ctx context.Context) error {
+	var problems []string
+
+	if c.Digest != "" && !imageDigest.MatchString(c.Digest) {
+		problems = append(problems, fmt.Sprintf("image: invalid digest %q", c.Digest))
+	}
+
+	// the same upstream name may be reused for routes to the same service,
+	// but not for different ones as the bindings would collide.
+	upstreams := map[string]dagger.ServiceID{}
+	bind := func(name string, svc *dagger.Service) (string, error) {
+		if svc == nil {
+			return fmt.Sprintf("upstream service %q is not set", name), nil
+		}
+
+		id, err := svc.ID(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		if other, ok := upstreams[name]; ok && other != id {
+			return fmt.Sprintf("upstream name %q is bound to different services", name), nil
+		}
+		upstreams[name] = id
+
+		return "", nil
+	}
+
+	listeners := map[string]string{}
+	routes := map[string]string{}
+	statics := map[string]bool{}
+	httpPorts := map[int32]bool{}
+	for i, svc := range c.Services {
+		name := svc.UpstreamName
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problems = append(problems, fmt.Sprintf("service %s: upstream name is empty", name))
+		} else if !isValidHostname(name) {
+			problems = append(problems, fmt.Sprintf("service %q: upstream name is not a valid DNS host name", name))
+		}
+
+		if svc.StaticDir != nil {
+			if _, ok := statics[svc.UpstreamName]; ok {
+				problems = append(problems, fmt.Sprintf("static site %q: name is already used by another static site", name))
+			}
+			statics[svc.UpstreamName] = true
+		} else if svc.proxied() && (svc.UpstreamPort < 1 || svc.UpstreamPort > 65535) {
+			problems = append(problems, fmt.Sprintf("service %q: upstream port %d is outside 1-65535", name, svc.UpstreamPort))
+		}
+
+		port := c.listenPort(svc)
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("service %q: listen port %d is outside 1-65535", name, port))
+		}
+		httpPorts[port] = true
+
+		if svc.Hostname != "" && !isValidHostname(svc.Hostname) {
+			problems = append(problems, fmt.Sprintf("service %q: %q is not a valid host name", name, svc.Hostname))
+		}
+
+		if svc.Path != "" && !strings.HasPrefix(svc.Path, "/") && svc.Path != "*" {
+			problems = append(problems, fmt.Sprintf("service %q: path %q must start with /", name, svc.Path))
+		}
+
+		if !svc.proxied() {
+			// static sites and stubs are answered by caddy itself, so proxy
+			// settings would be silently ignored.
+			if svc.HealthPath != "" {
+				problems = append(problems, fmt.Sprintf("service %q: health checks can only be used on proxied routes", name))
+			}
+
+			if len(svc.Replicas) > 0 || svc.LBPolicy != "" || svc.FailDuration != "" || svc.MaxFails > 0 {
+				problems = append(problems, fmt.Sprintf("service %q: replicas and load balancing can only be used on proxied routes", name))
+			}
+
+			if svc.UpstreamProtocol != "" {
+				problems = append(problems, fmt.Sprintf("service %q: upstream protocols can only be set on proxied routes", name))
+			}
+
+			if svc.FlushInterval != "" || svc.ReadTimeout != "" || svc.WriteTimeout != "" {
+				problems = append(problems, fmt.Sprintf("service %q: streaming options can only be set on proxied routes", name))
+			}
+		}
+
+		if svc.UpstreamProtocol != "" && !slices.Contains(upstreamProtocols, svc.UpstreamProtocol) {
+			problems = append(problems, fmt.Sprintf("service %q: unknown upstream protocol %q", name, svc.UpstreamProtocol))
+		}
+
+		if svc.LBPolicy != "" && !slices.Contains(lbPolicies, svc.LBPolicy) {
+			problems = append(problems, fmt.Sprintf("service %q: unknown load balancing policy %q", name, svc.LBPolicy))
+		}
+
+		if svc.FlushInterval != "" && svc.FlushInterval != "-1" {
+			if _, err := time.ParseDuration(svc.FlushInterval); err != nil {
+				problems = append(problems, fmt.Sprintf("service %q: invalid flush interval %q", name, svc.FlushInterval))
+			}
+		}
+
+		for _, timeout := range []string{svc.ReadTimeout, svc.WriteTimeout} {
+			if timeout == "" {
+				continue
+			}
+
+			if _, err := time.ParseDuration(timeout); err != nil {
+				problems = append(problems, fmt.Sprintf("service %q: invalid timeout %q", name, timeout))
+			}
+		}
+
+		if svc.FailDuration != "" {
+			if _, err := time.ParseDuration(svc.FailDuration); err != nil {
+				problems = append(problems, fmt.Sprintf("service %q: invalid fail duration %q", name, svc.FailDuration))
+			}
+		}
+
+		if svc.HealthPath != "" && !strings.HasPrefix(svc.HealthPath, "/") {
+			problems = append(problems, fmt.Sprintf("service %q: health check path %q must start with /", name, svc.HealthPath))
+		}
+
+		if svc.HealthInterval != "" {
+			if _, err := time.ParseDuration(svc.HealthInterval); err != nil {
+				problems = append(problems, fmt.Sprintf("service %q: invalid health check interval %q", name, svc.HealthInterval))
+			}
+		}
+
+		if svc.HealthStatus != "" && !healthStatus.MatchString(svc.HealthStatus) {
+			problems = append(problems, fmt.Sprintf("service %q: invalid health check status %q", name, svc.HealthStatus))
+		}
+
+		if svc.MaxRequestBody != "" && !byteSize.MatchString(svc.MaxRequestBody) {
+			problems = append(problems, fmt.Sprintf("service %q: invalid max request body size %q", name, svc.MaxRequestBody))
+		}
+
+		if limit := svc.RateLimit; limit != nil {
+			if limit.Events < 1 {
+				problems = append(problems, fmt.Sprintf("service %q: rate limit events must be at least 1", name))
+			}
+
+			if _, err := time.ParseDuration(limit.Window); err != nil {
+				problems = append(problems, fmt.Sprintf("service %q: invalid rate limit window %q", name, limit.Window))
+			}
+		}
+
+		if faults := svc.Faults; faults != nil {
+			if faults.Latency != "" {
+				if _, err := time.ParseDuration(faults.Latency); err != nil {
+					problems = append(problems, fmt.Sprintf("service %q: invalid fault latency %q", name, faults.Latency))
+				}
+
+				if !svc.proxied() {
+					problems = append(problems, fmt.Sprintf("service %q: latency can only be injected into proxied routes", name))
+				}
+
+				if svc.balanced() {
+					problems = append(problems, fmt.Sprintf("service %q: latency can't be combined with replicas, load balancing or health checks", name))
+				}
+			}
+
+			if faults.ErrorPercent < 0 || faults.DropPercent < 0 || faults.ErrorPercent+faults.DropPercent > 100 {
+				problems = append(problems, fmt.Sprintf("service %q: fault percentages must be between 0 and 100 in total", name))
+			}
+
+			if faults.ErrorStatus < 500 || faults.ErrorStatus > 599 {
+				problems = append(problems, fmt.Sprintf("service %q: fault status %d is not a 5xx status", name, faults.ErrorStatus))
+			}
+		}
+
+		if mirror := svc.Mirror; mirror != nil {
+			if !svc.proxied() {
+				problems = append(problems, fmt.Sprintf("service %q: only proxied routes can be mirrored", name))
+			}
+
+			if svc.UpstreamProtocol == "https-insecure" {
+				problems = append(problems, fmt.Sprintf("service %q: https upstreams can't be mirrored", name))
+			}
+
+			if svc.balanced() {
+				problems = append(problems, fmt.Sprintf("service %q: mirroring can't be combined with replicas, load balancing or health checks", name))
+			}
+
+			if mirror.UpstreamPort < 1 || mirror.UpstreamPort > 65535 {
+				problems = append(problems, fmt.Sprintf("service %q: shadow port %d is outside 1-65535", name, mirror.UpstreamPort))
+			}
+
+			if !isValidHostname(mirror.UpstreamName) {
+				problems = append(problems, fmt.Sprintf("service %q: shadow name %q is not a valid DNS host name", name, mirror.UpstreamName))
+			}
+		}
+
+		if svc.HTTPSRedirect && !c.servesTLS(svc) {
+			problems = append(problems, fmt.Sprintf("service %q: https redirects need TLS, use with-internal-tls or with-tls-certificate", name))
+		}
+
+		if len(svc.HostAliases) > 0 && svc.Hostname == "" {
+			problems = append(problems, fmt.Sprintf("service %q: canonical host redirects need a host route", name))
+		}
+
+		for _, alias := range svc.HostAliases {
+			if !isValidHostname(alias) || alias == svc.Hostname {
+				problems = append(problems, fmt.Sprintf("service %q: invalid host alias %q", name, alias))
+			}
+		}
+
+		for _, port := range c.redirectPorts(svc) {
+			httpPorts[port] = true
+		}
+
+		for _, rewrite := range svc.Rewrites {
+			if !strings.HasPrefix(rewrite.Path, "/") && rewrite.Path != "*" {
+				problems = append(problems, fmt.Sprintf("service %q: rewrite path %q must start with /", name, rewrite.Path))
+			}
+
+			if rewrite.To == "" {
+				problems = append(problems, fmt.Sprintf("service %q: rewrite of %s has no target", name, rewrite.Path))
+			}
+		}
+
+		for _, encoding := range svc.Encodings {
+			if !slices.Contains(contentEncodings, encoding) {
+				problems = append(problems, fmt.Sprintf("service %q: unknown encoding %q", name, encoding))
+			}
+		}
+
+		for _, stub := range svc.Stubs {
+			if !strings.HasPrefix(stub.Path, "/") {
+				problems = append(problems, fmt.Sprintf("stub route %q: path %q must start with /", name, stub.Path))
+			}
+
+			if stub.Status < 100 || stub.Status > 599 {
+				problems = append(problems, fmt.Sprintf("stub route %q: status %d of %s is outside 100-599", name, stub.Status, stub.Path))
+			}
+
+			for _, header := range stub.Headers {
+				if field, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(field) == "" {
+					problems = append(problems, fmt.Sprintf("stub route %q: header %q of %s is not formatted as Name: value", name, header, stub.Path))
+				}
+			}
+		}
+
+		for _, user := range svc.BasicAuth {
+			if user.Username == "" || strings.ContainsAny(user.Username, " \t\r\n") {
+				problems = append(problems, fmt.Sprintf("service %q: invalid basic auth user name %q", name, user.Username))
+			}
+		}
+
+		if auth := svc.ForwardAuth; auth != nil {
+			if auth.UpstreamPort < 1 || auth.UpstreamPort > 65535 {
+				problems = append(problems, fmt.Sprintf("service %q: forward auth port %d is outside 1-65535", name, auth.UpstreamPort))
+			}
+
+			if !isValidHostname(auth.UpstreamName) {
+				problems = append(problems, fmt.Sprintf("service %q: forward auth name %q is not a valid DNS host name", name, auth.UpstreamName))
+			}
+
+			if !strings.HasPrefix(auth.URI, "/") {
+				problems = append(problems, fmt.Sprintf("service %q: forward auth uri %q must start with /", name, auth.URI))
+			}
+		}
+
+		for _, rule := range svc.Headers {
+			if problem := rule.validate(); problem != "" {
+				problems = append(problems, fmt.Sprintf("service %q: %s", name, problem))
+			}
+
+			if !rule.Response && !svc.proxied() {
+				problems = append(problems, fmt.Sprintf("service %q: request header %q can only be set on proxied routes", name, rule.Name))
+			}
+		}
+
+		for _, u := range svc.bindings() {
+			problem, err := bind(u.name, u.svc)
+			if err != nil {
+				return err
+			}
+
+			if problem != "" {
+				problems = append(problems, fmt.Sprintf("service %q: %s", name, problem))
+			}
+		}
+
+		address := strings.Join(c.siteAddresses(svc), ", ")
+		if svc.Hostname == "" && svc.Path == "" {
+			if other, ok := listeners[address]; ok {
+				problems = append(problems, fmt.Sprintf("service %q: listen address %s is already used by %q", name, address, other))
+				continue
+			}
+			listeners[address] = name
+		}
+
+		route := address + " " + routePath(svc.Path)
+		if other, ok := routes[route]; ok {
+			problems = append(problems, fmt.Sprintf("service %q: route %s is already used by %q", name, route, other))
+		}
+		routes[route] = name
+	}
+
+	sites := map[string]bool{}
+	for _, svc := range c.Services {
+		for _, address := range c.siteAddresses(svc) {
+			sites[address] = true
+		}
+	}
+
+	for _, s := range c.redirectSites() {
+		if sites[s.Addresses[0]] {
+			problems = append(problems, fmt.Sprintf("redirect: site %s is already used by a route", s.Addresses[0]))
+		}
+	}
+
+	if c.Metrics {
+		if c.MetricsPort < 1 || c.MetricsPort > 65535 {
+			problems = append(problems, fmt.Sprintf("metrics: port %d is outside 1-65535", c.MetricsPort))
+		}
+
+		if httpPorts[c.MetricsPort] {
+			problems = append(problems, fmt.Sprintf("metrics: port %d is already used by an http service", c.MetricsPort))
+		}
+		httpPorts[c.MetricsPort] = true
+	}
+
+	l4Listeners := map[string]string{}
+	for i, svc := range c.L4Services {
+		name := svc.UpstreamName
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+			problems = append(problems, fmt.Sprintf("%s service %s: upstream name is empty", svc.Protocol, name))
+		} else if !isValidHostname(name) {
+			problems = append(problems, fmt.Sprintf("%s service %q: upstream name is not a valid DNS host name", svc.Protocol, name))
+		}
+
+		if svc.UpstreamPort < 1 || svc.UpstreamPort > 65535 {
+			problems = append(problems, fmt.Sprintf("%s service %q: upstream port %d is outside 1-65535", svc.Protocol, name, svc.UpstreamPort))
+		}
+
+		if svc.ListenPort < 1 || svc.ListenPort > 65535 {
+			problems = append(problems, fmt.Sprintf("%s service %q: listen port %d is outside 1-65535", svc.Protocol, name, svc.ListenPort))
+		}
+
+		if svc.Protocol == "tcp" && httpPorts[svc.ListenPort] {
+			problems = append(problems, fmt.Sprintf("tcp service %q: listen port %d is already used by an http service", name, svc.ListenPort))
+		}
+
+		address := svc.listenAddress()
+		if other, ok := l4Listeners[address]; ok {
+			problems = append(problems, fmt.Sprintf("%s service %q: listen address %s is already used by %q", svc.Protocol, name, address, other))
+		}
+		l4Listeners[address] = name
+
+		problem, err := bind(svc.UpstreamName, svc.UpstreamSvc)
+		if err != nil {
+			return err
+		}
+
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s service %q: %s", svc.Protocol, name, problem))
+		}
+	}
+
+	for _, svc := range c.Services {
+		// the loopback listeners of the layer4 hops and mirrors must not
+		// shadow a service.
+		for _, port := range []int32{c.hopPort(svc), c.mirrorPort(svc)} {
+			if port != 0 && (httpPorts[port] || l4Listeners[fmt.Sprintf(":%d", port)] != "") {
+				problems = append(problems, fmt.Sprintf("service %q: loopback port %d is already used by another service", svc.UpstreamName, port))
+			}
+		}
+	}
+
+	if c.InternalTLS {
+		if len(c.TLSHostnames) == 0 {
+			problems = append(problems, "tls: no host names to issue certificates for")
+		}
+
+		for _, hostname := range c.TLSHostnames {
+			if !isValidHostname(hostname) && net.ParseIP(hostname) == nil {
+				problems = append(problems, fmt.Sprintf("tls: %q is not a valid host name or IP address", hostname))
+			}
+		}
+	}
+
+	// a certificate no site uses would be mounted, but silently ignored
+	usedCerts := map[int]bool{}
+	for _, svc := range c.Services {
+		usedCerts[c.siteCertificate(svc)] = true
+		for _, alias := range svc.HostAliases {
+			usedCerts[c.siteCertificate(svc.aliasRoute(alias))] = true
+		}
+	}
+
+	for i, cert := range c.Certificates {
+		if !usedCerts[i] {
+			problems = append(problems, fmt.Sprintf("certificate #%d: no site uses it, it only applies to host routes matching its host names, or with with-internal-tls", i+1))
+		}
+
+		if cert.Cert == nil || cert.Key == nil {
+			problems = append(problems, fmt.Sprintf("certificate #%d: certificate and key are required", i+1))
+		}
+
+		if len(cert.Hostnames) == 0 {
+			problems = append(problems, fmt.Sprintf("certificate #%d: no host names", i+1))
+		}
+
+		for _, hostname := range cert.Hostnames {
+			if !isValidHostname(strings.TrimPrefix(hostname, "*.")) && net.ParseIP(hostname) == nil {
+				problems = append(problems, fmt.Sprintf("certificate #%d: %q is not a valid host name or IP address", i+1, hostname))
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid caddy configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+func isValidHostname(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabel.MatchString(label) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// routePath normalizes the catch-all path matchers, so that they compare equal.
+func routePath(path string) string {
+	if isCatchAllPath(path) {
+		return "/*"
+	}
+
+	return path
+}